@@ -6,39 +6,146 @@ package aes
 import (
 	"context"
 	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"reflect"
 
+	"golang.org/x/crypto/hkdf"
 	"gorm.io/gorm/schema"
 
 	"go.pitz.tech/gorm/encryption/database"
 	"go.pitz.tech/gorm/encryption/internal"
+	"go.pitz.tech/gorm/encryption/internal/siv"
 )
 
-// New constructs a new Serializer using the provided key and computes a fingerprint for the key.
-func New(key []byte) *Serializer {
+// New constructs a new Serializer using the provided keyring and computes a fingerprint for each key. The first key is
+// used to encrypt new values while the remaining keys are only used to decrypt values that were previously encrypted
+// with them. This allows multiple root keys to be used while rotating between them.
+func New(key []byte, keyring ...[]byte) *Serializer {
+	serializer := &Serializer{
+		fingerprint: Fingerprint(key),
+		keys:        make(map[string]keyCiphers, len(keyring)+1),
+		usage:       &internal.Usage{},
+	}
+
+	serializer.keys[serializer.fingerprint] = newKeyCiphers(key)
+	for _, key := range keyring {
+		serializer.keys[Fingerprint(key)] = newKeyCiphers(key)
+	}
+
+	return serializer
+}
+
+// keyCiphers holds the ciphers constructed for a key, or the error returned while constructing them. Ciphers are
+// constructed once per key rather than for every value.
+type keyCiphers struct {
+	// block is used to decrypt values written using the legacy aes algorithm.
+	block cipher.Block
+	siv   cipher.AEAD
+
+	// fingerprintKey is used to fingerprint the data keys wrapped using the key.
+	fingerprintKey []byte
+
+	err error
+}
+
+func newKeyCiphers(key []byte) keyCiphers {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return keyCiphers{err: err}
+	}
+
+	// the legacy algorithm used the key directly, so a separate key is derived for AES-SIV
+	sivKey := make([]byte, 64)
+
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(internal.AES_SIV.Name)), sivKey)
+	if err != nil {
+		return keyCiphers{err: err}
+	}
+
+	aead, err := siv.New(sivKey)
+	if err != nil {
+		return keyCiphers{err: err}
+	}
+
+	fingerprintKey := make([]byte, 32)
+
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("fingerprint")), fingerprintKey)
+	if err != nil {
+		return keyCiphers{err: err}
+	}
+
+	return keyCiphers{block: block, siv: aead, fingerprintKey: fingerprintKey}
+}
+
+// Fingerprint computes the fingerprint used to identify the provided key.
+func Fingerprint(key []byte) string {
 	hash := hmac.New(sha256.New, nil)
 	hash.Write(key)
 
-	return &Serializer{
-		fingerprint: base64.RawURLEncoding.EncodeToString(hash.Sum(nil)),
-		key:         key,
-	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
 }
 
-// Serializer provides a Gorm serializer capable of encrypting and decrypting database fields using a simple AES block
-// cipher. This approach works well for large, generated values that have a high probability of being unique. For more
-// common values, take a look at the aesgcm.Serializer implementation.
+// UnknownKeyError is returned when a value was encrypted using a key that isn't part of the keyring.
+type UnknownKeyError struct {
+	Fingerprint string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("no key found for fingerprint: %s", e.Fingerprint)
+}
+
+// Serializer provides a Gorm serializer capable of deterministically encrypting and decrypting database fields using
+// AES-SIV (RFC 5297). Encrypting the same value twice using the same key produces the same ciphertext, allowing
+// encrypted values to be compared for equality. Since this reveals which values are equal, it works best for values
+// that have a high probability of being unique. For more common values, take a look at the aesgcm.Serializer
+// implementation. Values written using the legacy aes algorithm, which encrypted each block independently, can still be
+// decrypted.
 type Serializer struct {
 	fingerprint string
-	key         []byte
+	keys        map[string]keyCiphers
+
+	// usage is shared between copies of the serializer, since gorm copies serializers when operating on fields.
+	usage *internal.Usage
+
+	// fallback reads values written using other algorithms, when configured.
+	fallback schema.SerializerInterface
+}
+
+// WithFallback returns a Serializer that reads values written using other algorithms using the fallback, rather than
+// returning an error. New values are still written using AES-SIV.
+func (s *Serializer) WithFallback(fallback schema.SerializerInterface) *Serializer {
+	variant := *s
+	variant.fallback = fallback
+
+	return &variant
+}
+
+// Stats reports how a Serializer has been used.
+type Stats = internal.Stats
+
+// Stats returns a snapshot of how the serializer has been used. Values read using the fallback and data keys wrapped
+// using the serializer aren't counted.
+func (s *Serializer) Stats() Stats {
+	return s.usage.Stats()
+}
+
+// Close prevents the serializer from being used to encrypt or decrypt any more values.
+func (s *Serializer) Close() error {
+	s.usage.Closed.Store(true)
+	return nil
 }
 
 // Scan decrypts the data before setting it on the object.
 func (s *Serializer) Scan(ctx context.Context, schema *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	if s.usage.Closed.Load() {
+		return internal.ErrClosed
+	}
+
 	data, ok := dbValue.([]byte)
 	if !ok {
 		return fmt.Errorf("encryption only works on []byte data")
@@ -48,21 +155,16 @@ func (s *Serializer) Scan(ctx context.Context, schema *schema.Field, dst reflect
 	switch {
 	case fingerprint == "":
 		return nil
-	case algorithm != internal.AES.ID:
-		return fmt.Errorf("expected %s but got: %s", internal.AES.Name, internal.AlgorithmsByID[algorithm].Name)
+	case algorithm != internal.AES_SIV.ID && algorithm != internal.AES.ID && s.fallback != nil:
+		return s.fallback.Scan(ctx, schema, dst, dbValue)
 	}
 
-	block, err := aes.NewCipher(s.key)
+	plaintext, err := s.decrypt(algorithm, fingerprint, ciphertext)
 	if err != nil {
 		return err
 	}
 
-	plaintext := make([]byte, len(ciphertext))
-
-	blockSize := block.BlockSize()
-	for i := 0; i < len(plaintext); i += blockSize {
-		block.Decrypt(plaintext[i:], ciphertext[i:])
-	}
+	s.usage.Decrypted.Add(1)
 
 	schema.ReflectValueOf(ctx, dst).SetBytes(plaintext)
 
@@ -71,22 +173,107 @@ func (s *Serializer) Scan(ctx context.Context, schema *schema.Field, dst reflect
 
 // Value encrypts the data before sending it to the database.
 func (s *Serializer) Value(_ context.Context, _ *schema.Field, _ reflect.Value, fieldValue interface{}) (interface{}, error) {
+	if s.usage.Closed.Load() {
+		return nil, internal.ErrClosed
+	}
+
 	plaintext, ok := fieldValue.([]byte)
 	if !ok {
 		return nil, fmt.Errorf("encryption only works on []byte data")
 	}
 
-	block, err := aes.NewCipher(s.key)
+	ciphertext, err := s.encrypt(plaintext)
 	if err != nil {
 		return nil, err
 	}
 
-	ciphertext := make([]byte, len(plaintext))
+	s.usage.Encrypted.Add(1)
+
+	return database.FormatField(internal.AES_SIV.ID, s.fingerprint, ciphertext), nil
+}
+
+// CurrentFingerprint returns the fingerprint of the key used to encrypt new values, allowing columns to be
+// re-encrypted using the current key and algorithm.
+func (s *Serializer) CurrentFingerprint(context.Context) (string, error) {
+	return s.fingerprint, nil
+}
+
+// AlgorithmID returns the ID of the algorithm used to encrypt new values.
+func (s *Serializer) AlgorithmID() byte {
+	return internal.AES_SIV.ID
+}
+
+// KeyID returns the fingerprint of the key used by the serializer.
+func (s *Serializer) KeyID() string {
+	return s.fingerprint
+}
+
+// FingerprintKey returns a key derived from the current key, allowing the Serializer to be used as a
+// database.FingerprintKeyProvider.
+func (s *Serializer) FingerprintKey() []byte {
+	return s.keys[s.fingerprint].fingerprintKey
+}
+
+// Wrap encrypts the provided data key, allowing the Serializer to be used as a database.KeyProvider.
+func (s *Serializer) Wrap(_ context.Context, dataKey []byte) ([]byte, error) {
+	ciphertext, err := s.encrypt(dataKey)
+	if err != nil {
+		return nil, err
+	}
 
+	return database.FormatField(internal.AES_SIV.ID, s.fingerprint, ciphertext), nil
+}
+
+// Unwrap decrypts a data key previously encrypted using Wrap. Data keys wrapped using the legacy aes algorithm can
+// still be unwrapped, but should be re-wrapped using RotateRootKey.
+func (s *Serializer) Unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	algorithm, fingerprint, ciphertext := database.ParseField(wrapped)
+	if fingerprint == "" {
+		return nil, fmt.Errorf("data key is not encrypted")
+	}
+
+	return s.decrypt(algorithm, fingerprint, ciphertext)
+}
+
+func (s *Serializer) encrypt(plaintext []byte) ([]byte, error) {
+	key := s.keys[s.fingerprint]
+	if key.err != nil {
+		return nil, key.err
+	}
+
+	return key.siv.Seal(nil, nil, plaintext, nil), nil
+}
+
+func (s *Serializer) decrypt(algorithm byte, fingerprint string, ciphertext []byte) ([]byte, error) {
+	if algorithm != internal.AES_SIV.ID && algorithm != internal.AES.ID {
+		return nil, internal.UnexpectedAlgorithm(internal.AES_SIV, algorithm)
+	}
+
+	key, ok := s.keys[fingerprint]
+	switch {
+	case !ok:
+		return nil, &UnknownKeyError{Fingerprint: fingerprint}
+	case key.err != nil:
+		return nil, key.err
+	case algorithm == internal.AES_SIV.ID:
+		return key.siv.Open(nil, nil, ciphertext, nil)
+	}
+
+	return decryptLegacy(key.block, ciphertext)
+}
+
+// decryptLegacy decrypts a value written using the legacy aes algorithm, which encrypted each block independently. The
+// legacy algorithm could only encrypt values that were a multiple of the block size, so any other value is invalid.
+func decryptLegacy(block cipher.Block, ciphertext []byte) ([]byte, error) {
 	blockSize := block.BlockSize()
+	if len(ciphertext)%blockSize != 0 {
+		return nil, fmt.Errorf("%s ciphertext must be a multiple of %d bytes but got: %d", internal.AES.Name, blockSize, len(ciphertext))
+	}
+
+	plaintext := make([]byte, len(ciphertext))
 	for i := 0; i < len(plaintext); i += blockSize {
-		block.Encrypt(ciphertext[i:], plaintext[i:])
+		block.Decrypt(plaintext[i:], ciphertext[i:])
 	}
 
-	return database.FormatField(internal.AES.ID, s.fingerprint, ciphertext), nil
+	return plaintext, nil
 }
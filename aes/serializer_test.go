@@ -0,0 +1,352 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package aes_test
+
+import (
+	"bytes"
+	"context"
+	stdaes "crypto/aes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/aes"
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+func TestKeyProvider(t *testing.T) {
+	i := is.New(t)
+	ctx := context.Background()
+
+	rootKey, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	dataKey, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	var provider database.KeyProvider = aes.New(rootKey)
+
+	wrapped, err := provider.Wrap(ctx, dataKey)
+	i.NoErr(err)
+
+	algorithm, fingerprint, ciphertext := database.ParseField(wrapped)
+	i.Equal(internal.AES_SIV.ID, algorithm)
+	i.Equal(provider.KeyID(), fingerprint)
+	i.True(string(ciphertext) != string(dataKey))
+
+	unwrapped, err := provider.Unwrap(ctx, wrapped)
+	i.NoErr(err)
+	i.Equal(dataKey, unwrapped)
+
+	// data keys previously written using the serializer must continue to unwrap
+	value, err := aes.New(rootKey).Value(ctx, nil, reflect.Value{}, dataKey)
+	i.NoErr(err)
+
+	unwrapped, err = provider.Unwrap(ctx, value.([]byte))
+	i.NoErr(err)
+	i.Equal(dataKey, unwrapped)
+
+	// data keys wrapped using the legacy algorithm must continue to unwrap
+	unwrapped, err = provider.Unwrap(ctx, legacyEncrypt(i, rootKey, dataKey))
+	i.NoErr(err)
+	i.Equal(dataKey, unwrapped)
+}
+
+func TestFingerprintKey(t *testing.T) {
+	i := is.New(t)
+
+	rootKey, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	otherKey, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	var provider database.FingerprintKeyProvider = aes.New(rootKey, otherKey)
+
+	// the fingerprint key is derived from the current root key, rather than its public KeyID
+	i.Equal(32, len(provider.FingerprintKey()))
+	i.Equal(provider.FingerprintKey(), aes.New(rootKey).FingerprintKey())
+	i.True(!bytes.Equal(provider.FingerprintKey(), aes.New(otherKey).FingerprintKey()))
+	i.True(!bytes.Equal(provider.FingerprintKey(), rootKey))
+
+	// invalid keys have no fingerprint key
+	i.Equal(nil, aes.New(make([]byte, 7)).FingerprintKey())
+}
+
+// legacyEncrypt encrypts the plaintext using the legacy aes algorithm, which encrypted each block independently.
+func legacyEncrypt(i *is.I, key, plaintext []byte) []byte {
+	block, err := stdaes.NewCipher(key)
+	i.NoErr(err)
+
+	ciphertext := make([]byte, len(plaintext))
+	for idx := 0; idx < len(plaintext); idx += block.BlockSize() {
+		block.Encrypt(ciphertext[idx:], plaintext[idx:])
+	}
+
+	return database.FormatField(internal.AES.ID, aes.Fingerprint(key), ciphertext)
+}
+
+func TestDeterministic(t *testing.T) {
+	i := is.New(t)
+	ctx := context.Background()
+
+	key, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	sch, err := schema.Parse(&keyringRecord{}, &sync.Map{}, schema.NamingStrategy{})
+	i.NoErr(err)
+
+	field := sch.LookUpField("value")
+	serializer := aes.New(key)
+
+	// the same plaintext always produces the same value, allowing values to be compared for equality
+	first, err := serializer.Value(ctx, field, reflect.Value{}, []byte("repeated value"))
+	i.NoErr(err)
+
+	second, err := aes.New(key).Value(ctx, field, reflect.Value{}, []byte("repeated value"))
+	i.NoErr(err)
+	i.Equal(first, second)
+
+	other, err := serializer.Value(ctx, field, reflect.Value{}, []byte("repeated valuf"))
+	i.NoErr(err)
+	i.True(string(first.([]byte)) != string(other.([]byte)))
+
+	// values are authenticated, unlike the legacy algorithm
+	tampered := append([]byte{}, first.([]byte)...)
+	tampered[len(tampered)-1] ^= 1
+
+	err = serializer.Scan(ctx, field, reflect.ValueOf(&keyringRecord{}), tampered)
+	i.True(err != nil)
+
+	// values written using the legacy algorithm can still be read
+	plaintext, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	record := &keyringRecord{}
+	err = serializer.Scan(ctx, field, reflect.ValueOf(record), legacyEncrypt(i, key, plaintext))
+	i.NoErr(err)
+	i.Equal(plaintext, record.Value)
+}
+
+// legacyFixture was written by the legacy aes algorithm, using a key containing the bytes 0 through 31 to encrypt a
+// value containing the bytes 32 through 63.
+const legacyFixture = "61a6936e4e8f101c1cc1f993b542a0d4e2740e8afad4e4d15d0d661b382eca89"
+
+func TestLegacyFixture(t *testing.T) {
+	i := is.New(t)
+	ctx := context.Background()
+
+	key := make([]byte, 32)
+	plaintext := make([]byte, 32)
+	for idx := range key {
+		key[idx] = byte(idx)
+		plaintext[idx] = byte(idx + 32)
+	}
+
+	ciphertext, err := hex.DecodeString(legacyFixture)
+	i.NoErr(err)
+
+	sch, err := schema.Parse(&keyringRecord{}, &sync.Map{}, schema.NamingStrategy{})
+	i.NoErr(err)
+
+	field := sch.LookUpField("value")
+	serializer := aes.New(key)
+
+	record := &keyringRecord{}
+	err = serializer.Scan(ctx, field, reflect.ValueOf(record), database.FormatField(internal.AES.ID, aes.Fingerprint(key), ciphertext))
+	i.NoErr(err)
+	i.Equal(plaintext, record.Value)
+
+	unwrapped, err := serializer.Unwrap(ctx, database.FormatField(internal.AES.ID, aes.Fingerprint(key), ciphertext))
+	i.NoErr(err)
+	i.Equal(plaintext, unwrapped)
+
+	// legacy values that aren't a multiple of the block size return an error instead of panicking
+	err = serializer.Scan(ctx, field, reflect.ValueOf(record), database.FormatField(internal.AES.ID, aes.Fingerprint(key), ciphertext[:17]))
+	i.True(err != nil)
+}
+
+func TestLengths(t *testing.T) {
+	i := is.New(t)
+	ctx := context.Background()
+
+	key, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	sch, err := schema.Parse(&keyringRecord{}, &sync.Map{}, schema.NamingStrategy{})
+	i.NoErr(err)
+
+	field := sch.LookUpField("value")
+	serializer := aes.New(key)
+
+	plaintext := make([]byte, 4096)
+	_, err = rand.Read(plaintext)
+	i.NoErr(err)
+
+	for length := 0; length <= len(plaintext); length++ {
+		value, err := serializer.Value(ctx, field, reflect.Value{}, plaintext[:length])
+		i.NoErr(err)
+
+		record := &keyringRecord{}
+		err = serializer.Scan(ctx, field, reflect.ValueOf(record), value)
+		i.NoErr(err)
+		i.True(bytes.Equal(plaintext[:length], record.Value))
+	}
+}
+
+func FuzzSerializer(f *testing.F) {
+	key, err := internal.GenerateKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	sch, err := schema.Parse(&keyringRecord{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	field := sch.LookUpField("value")
+	serializer := aes.New(key)
+
+	for _, length := range []int{0, 1, 15, 16, 17, 31, 32, 33, 4096} {
+		f.Add(make([]byte, length))
+	}
+
+	f.Fuzz(func(t *testing.T, plaintext []byte) {
+		ctx := context.Background()
+
+		value, err := serializer.Value(ctx, field, reflect.Value{}, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record := &keyringRecord{}
+		err = serializer.Scan(ctx, field, reflect.ValueOf(record), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(plaintext, record.Value) {
+			t.Fatalf("expected %x but got: %x", plaintext, record.Value)
+		}
+
+		// arbitrary values must never cause a panic, regardless of the algorithm they claim to use
+		for _, algorithm := range []byte{internal.AES.ID, internal.AES_SIV.ID} {
+			_ = serializer.Scan(ctx, field, reflect.ValueOf(&keyringRecord{}), database.FormatField(algorithm, aes.Fingerprint(key), plaintext))
+		}
+	})
+}
+
+type keyringRecord struct {
+	Value []byte
+}
+
+func TestKeyring(t *testing.T) {
+	i := is.New(t)
+	ctx := context.Background()
+
+	oldKey, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	newKey, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	sch, err := schema.Parse(&keyringRecord{}, &sync.Map{}, schema.NamingStrategy{})
+	i.NoErr(err)
+
+	field := sch.LookUpField("value")
+
+	plaintext, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	value, err := aes.New(oldKey).Value(ctx, field, reflect.Value{}, plaintext)
+	i.NoErr(err)
+
+	{
+		// values encrypted using a previous key can be decrypted using the keyring
+		record := &keyringRecord{}
+		err = aes.New(newKey, oldKey).Scan(ctx, field, reflect.ValueOf(record), value)
+		i.NoErr(err)
+		i.Equal(plaintext, record.Value)
+	}
+
+	{
+		// values encrypted using an unknown key return an error
+		record := &keyringRecord{}
+		err = aes.New(newKey).Scan(ctx, field, reflect.ValueOf(record), value)
+
+		unknownKey := &aes.UnknownKeyError{}
+		i.True(errors.As(err, &unknownKey))
+		i.Equal(aes.Fingerprint(oldKey), unknownKey.Fingerprint)
+		i.Equal(nil, record.Value)
+	}
+
+	{
+		// new values are encrypted using the first key
+		value, err := aes.New(newKey, oldKey).Value(ctx, field, reflect.Value{}, plaintext)
+		i.NoErr(err)
+
+		_, fingerprint, _ := database.ParseField(value.([]byte))
+		i.Equal(aes.Fingerprint(newKey), fingerprint)
+	}
+}
+
+func BenchmarkSerializer(b *testing.B) {
+	i := is.New(b)
+	ctx := context.Background()
+
+	key, err := internal.GenerateKey()
+	i.NoErr(err)
+
+	sch, err := schema.Parse(&keyringRecord{}, &sync.Map{}, schema.NamingStrategy{})
+	i.NoErr(err)
+
+	field := sch.LookUpField("value")
+	serializer := aes.New(key)
+
+	sizes := map[string]int{
+		"small": 32,
+		"large": 64 * 1024,
+	}
+
+	for name, size := range sizes {
+		plaintext := make([]byte, size)
+
+		value, err := serializer.Value(ctx, field, reflect.Value{}, plaintext)
+		i.NoErr(err)
+
+		b.Run("Value/"+name, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			for n := 0; n < b.N; n++ {
+				_, err := serializer.Value(ctx, field, reflect.Value{}, plaintext)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run("Scan/"+name, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			record := &keyringRecord{}
+
+			for n := 0; n < b.N; n++ {
+				err := serializer.Scan(ctx, field, reflect.ValueOf(record), value)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+	"go.pitz.tech/gorm/encryption/sealedbox"
+)
+
+// RegisterAlgorithm adds an application provided algorithm to the registry and registers a serializer for it using the
+// algorithm's name. Values are formatted using database.FormatField with the algorithm's ID, so they can be told apart
+// from the values written by every other algorithm. See database.RegisterAlgorithm for the constraints on its ID and
+// name. The name cannot be one already used by another Gorm serializer, such as json or gob, although algorithms can be
+// registered again to replace their Cipher.
+func RegisterAlgorithm(algorithm database.Algorithm) error {
+	if existing, ok := schema.GetSerializer(algorithm.Name); ok {
+		if existing, ok := existing.(*cipherSerializer); !ok || existing.algorithm.ID != algorithm.ID {
+			return fmt.Errorf("a serializer named %s has already been registered", algorithm.Name)
+		}
+	}
+
+	err := database.RegisterAlgorithm(algorithm)
+	if err != nil {
+		return err
+	}
+
+	schema.RegisterSerializer(algorithm.Name, &cipherSerializer{algorithm: algorithm})
+
+	return nil
+}
+
+// RegisterSealedBox registers the sealed-box serializer without registering any of the serializers using symmetric
+// keys. Values are encrypted using the provided X25519 public key and can only be read using one of the private keys.
+// Processes that only write values, such as ingestion services, can be configured with just the public key so they
+// never hold a key capable of reading the data back. Processes that also need the other serializers should configure
+// the keys using WithPublicKey and WithPrivateKeys instead. An error is returned when any of the keys are invalid.
+func RegisterSealedBox(publicKey []byte, privateKeys ...[]byte) error {
+	serializer, err := sealedbox.New(publicKey, privateKeys...)
+	if err != nil {
+		return err
+	}
+
+	schema.RegisterSerializer(internal.SEALED_BOX.Name, serializer)
+
+	return nil
+}
+
+// algorithmDispatcher reads values using the serializer for the algorithm that wrote them, indexed by algorithm ID.
+// Values written using algorithms registered by the application are read using their Cipher. It's used as the fallback
+// of the registered serializers when universal decryption is enabled, so it never writes values itself.
+type algorithmDispatcher map[byte]schema.SerializerInterface
+
+// Scan decrypts the data using the serializer for the algorithm that wrote it.
+func (d algorithmDispatcher) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	data, ok := dbValue.([]byte)
+	if !ok {
+		return fmt.Errorf("encryption only works on []byte data")
+	}
+
+	algorithm, _, _ := database.ParseField(data)
+	if serializer, ok := d[algorithm]; ok {
+		return serializer.Scan(ctx, field, dst, dbValue)
+	}
+
+	registered, err := database.AlgorithmByID(algorithm)
+	switch {
+	case err != nil:
+		return err
+	case registered.Cipher == nil:
+		return fmt.Errorf("values written using %s cannot be read by other serializers", registered.Name)
+	}
+
+	return (&cipherSerializer{algorithm: registered}).Scan(ctx, field, dst, dbValue)
+}
+
+// Value returns an error, values are always written by the serializer configured for the field.
+func (d algorithmDispatcher) Value(context.Context, *schema.Field, reflect.Value, interface{}) (interface{}, error) {
+	return nil, fmt.Errorf("values cannot be written by the algorithm dispatcher")
+}
+
+// cipherSerializer provides a Gorm serializer that encrypts and decrypts []byte fields using the Cipher of an
+// application provided algorithm.
+type cipherSerializer struct {
+	algorithm database.Algorithm
+}
+
+// Scan decrypts the data before setting it on the object.
+func (s *cipherSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	data, ok := dbValue.([]byte)
+	if !ok {
+		return fmt.Errorf("encryption only works on []byte data")
+	}
+
+	algorithm, fingerprint, ciphertext := database.ParseField(data)
+	switch {
+	case fingerprint == "":
+		// field does not appear encrypted, treat data as plaintext
+		field.ReflectValueOf(ctx, dst).SetBytes(ciphertext)
+
+		return nil
+	case algorithm != s.algorithm.ID:
+		return internal.UnexpectedAlgorithm(s.algorithm, algorithm)
+	}
+
+	plaintext, err := s.algorithm.Cipher.Decrypt(ctx, fingerprint, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	field.ReflectValueOf(ctx, dst).SetBytes(plaintext)
+
+	return nil
+}
+
+// Value encrypts the data before sending it to the database.
+func (s *cipherSerializer) Value(ctx context.Context, _ *schema.Field, _ reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, ok := fieldValue.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("encryption only works on []byte data")
+	}
+
+	fingerprint, ciphertext, err := s.algorithm.Cipher.Encrypt(ctx, plaintext)
+	switch {
+	case err != nil:
+		return nil, err
+	case fingerprint == "":
+		// values without a fingerprint are read as plaintext
+		return nil, fmt.Errorf("algorithm %s did not return a fingerprint", s.algorithm.Name)
+	case strings.Contains(fingerprint, ","):
+		// the fingerprint is separated from the ciphertext using a comma
+		return nil, fmt.Errorf("algorithm %s returned a fingerprint containing a comma", s.algorithm.Name)
+	}
+
+	return database.FormatField(s.algorithm.ID, fingerprint, ciphertext), nil
+}
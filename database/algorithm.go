@@ -0,0 +1,146 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Algorithm identifies how the value of an encrypted field was encrypted. The ID is written as part of every field
+// formatted using FormatField, allowing values to be decrypted using the algorithm that encrypted them.
+type Algorithm struct {
+	ID   byte
+	Name string
+
+	// Cipher encrypts and decrypts values using the algorithm. The algorithms provided by this library are implemented
+	// by their serializers and have no Cipher.
+	Cipher Cipher
+}
+
+// Cipher encrypts and decrypts field values using an algorithm registered by an application.
+type Cipher interface {
+	// Encrypt encrypts the plaintext, returning the fingerprint of the key used along with the ciphertext. Fingerprints
+	// cannot be empty or contain a comma.
+	Encrypt(ctx context.Context, plaintext []byte) (fingerprint string, ciphertext []byte, err error)
+
+	// Decrypt decrypts a ciphertext previously produced by Encrypt using the key identified by the fingerprint.
+	Decrypt(ctx context.Context, fingerprint string, ciphertext []byte) ([]byte, error)
+}
+
+// The algorithms provided by this library.
+var (
+	AlgorithmUnknown           = Algorithm{ID: 0, Name: "unknown"}
+	AlgorithmAES               = Algorithm{ID: 1, Name: "aes"}
+	AlgorithmAESGCM            = Algorithm{ID: 2, Name: "aes-gcm"}
+	AlgorithmAESGCMRecord      = Algorithm{ID: 3, Name: "aes-gcm-record"}
+	AlgorithmChaCha20Poly1305  = Algorithm{ID: 4, Name: "chacha20poly1305"}
+	AlgorithmXChaCha20Poly1305 = Algorithm{ID: 5, Name: "xchacha20poly1305"}
+	AlgorithmAESSIV            = Algorithm{ID: 6, Name: "aes-siv"}
+	AlgorithmSealedBox         = Algorithm{ID: 7, Name: "sealed-box"}
+	AlgorithmAESGCMStream      = Algorithm{ID: 8, Name: "aes-gcm-stream"}
+)
+
+// MinCustomAlgorithmID is the smallest ID that can be used by algorithms registered using RegisterAlgorithm. Smaller
+// IDs are reserved for the algorithms provided by this library.
+const MinCustomAlgorithmID byte = 128
+
+// UnknownAlgorithmError is returned when looking up an algorithm that hasn't been registered, such as when reading a
+// value written by a newer version of an application or one that's been corrupted.
+type UnknownAlgorithmError struct {
+	ID   byte
+	Name string
+}
+
+func (e *UnknownAlgorithmError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("unknown algorithm: %s", e.Name)
+	}
+
+	return fmt.Sprintf("unknown algorithm: %d", e.ID)
+}
+
+var algorithms = struct {
+	sync.RWMutex
+	byID   map[byte]Algorithm
+	byName map[string]Algorithm
+}{
+	byID:   make(map[byte]Algorithm),
+	byName: make(map[string]Algorithm),
+}
+
+func init() {
+	for _, algorithm := range []Algorithm{
+		AlgorithmAES,
+		AlgorithmAESGCM,
+		AlgorithmAESGCMRecord,
+		AlgorithmChaCha20Poly1305,
+		AlgorithmXChaCha20Poly1305,
+		AlgorithmAESSIV,
+		AlgorithmSealedBox,
+		AlgorithmAESGCMStream,
+	} {
+		algorithms.byID[algorithm.ID] = algorithm
+		algorithms.byName[algorithm.Name] = algorithm
+	}
+}
+
+// RegisterAlgorithm adds an algorithm to the registry, allowing values encrypted using it to be identified by its ID.
+// The ID must be at least MinCustomAlgorithmID and neither the ID nor name can be used by another algorithm.
+// Registering an algorithm again using the same ID and name replaces its Cipher.
+func RegisterAlgorithm(algorithm Algorithm) error {
+	switch {
+	case algorithm.ID < MinCustomAlgorithmID:
+		return fmt.Errorf("algorithm %s must use an ID of at least %d but got: %d", algorithm.Name, MinCustomAlgorithmID, algorithm.ID)
+	case algorithm.Name == "":
+		return fmt.Errorf("algorithm %d must have a name", algorithm.ID)
+	case algorithm.Cipher == nil:
+		return fmt.Errorf("algorithm %s must have a cipher", algorithm.Name)
+	}
+
+	algorithms.Lock()
+	defer algorithms.Unlock()
+
+	if existing, ok := algorithms.byID[algorithm.ID]; ok && existing.Name != algorithm.Name {
+		return fmt.Errorf("algorithm ID %d is already used by %s", algorithm.ID, existing.Name)
+	}
+
+	if existing, ok := algorithms.byName[algorithm.Name]; ok && existing.ID != algorithm.ID {
+		return fmt.Errorf("algorithm name %s is already used by ID %d", algorithm.Name, existing.ID)
+	}
+
+	algorithms.byID[algorithm.ID] = algorithm
+	algorithms.byName[algorithm.Name] = algorithm
+
+	return nil
+}
+
+// AlgorithmByID returns the algorithm registered using the provided ID. An *UnknownAlgorithmError is returned when no
+// algorithm has been registered using the ID.
+func AlgorithmByID(id byte) (Algorithm, error) {
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+
+	algorithm, ok := algorithms.byID[id]
+	if !ok {
+		return Algorithm{}, &UnknownAlgorithmError{ID: id}
+	}
+
+	return algorithm, nil
+}
+
+// AlgorithmByName returns the algorithm registered using the provided name. An *UnknownAlgorithmError is returned when
+// no algorithm has been registered using the name.
+func AlgorithmByName(name string) (Algorithm, error) {
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+
+	algorithm, ok := algorithms.byName[name]
+	if !ok {
+		return Algorithm{}, &UnknownAlgorithmError{Name: name}
+	}
+
+	return algorithm, nil
+}
@@ -4,9 +4,11 @@
 package database_test
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"testing"
 
 	"github.com/matryer/is"
@@ -42,11 +44,116 @@ func TestField(t *testing.T) {
 		i.Equal(internal.AES.ID, algorithm)
 		i.Equal(expectedFingerprint, fingerprint)
 		i.Equal(expectedCiphertext, ciphertext)
+
+		// fields written without flags report none
+		_, flags, _, _ := database.ParseFlaggedField(field)
+		i.Equal(byte(0), flags)
+	}
+
+	{
+		expectedCiphertext := []byte("ciphertext, containing the delimiter")
+		expectedFlags := database.FlagColumnAAD | database.FlagRowAAD
+
+		field := database.FormatFlaggedField(internal.AES_GCM.ID, expectedFlags, "fingerprint", expectedCiphertext)
+
+		algorithm, flags, fingerprint, ciphertext := database.ParseFlaggedField(field)
+		i.Equal(internal.AES_GCM.ID, algorithm)
+		i.Equal(expectedFlags, flags)
+		i.Equal("fingerprint", fingerprint)
+		i.Equal(expectedCiphertext, ciphertext)
+
+		// flags do not change how the remaining components are parsed
+		algorithm, fingerprint, ciphertext = database.ParseField(field)
+		i.Equal(internal.AES_GCM.ID, algorithm)
+		i.Equal("fingerprint", fingerprint)
+		i.Equal(expectedCiphertext, ciphertext)
 	}
 }
 
+func TestMalformedField(t *testing.T) {
+	i := is.New(t)
+
+	// fields that aren't formatted correctly are treated as plaintext rather than panicking
+	for _, field := range []string{"ENC:", "ENC:,", "ENC:\x02", "ENC:\x02,fingerprint", "ENC:,fingerprint,ciphertext", "ENC:\x02\x01\x01,f,c"} {
+		algorithm, flags, fingerprint, ciphertext := database.ParseFlaggedField([]byte(field))
+		i.Equal(internal.Unknown.ID, algorithm)
+		i.Equal(byte(0), flags)
+		i.Equal("", fingerprint)
+		i.Equal(field, string(ciphertext))
+	}
+}
+
+type testCipher struct{}
+
+func (testCipher) Encrypt(_ context.Context, plaintext []byte) (string, []byte, error) {
+	return "test", plaintext, nil
+}
+
+func (testCipher) Decrypt(_ context.Context, _ string, ciphertext []byte) ([]byte, error) {
+	return ciphertext, nil
+}
+
+func TestAlgorithms(t *testing.T) {
+	i := is.New(t)
+
+	algorithm, err := database.AlgorithmByID(internal.AES_GCM.ID)
+	i.NoErr(err)
+	i.Equal(internal.AES_GCM, algorithm)
+
+	algorithm, err = database.AlgorithmByName(internal.AES_SIV.Name)
+	i.NoErr(err)
+	i.Equal(internal.AES_SIV, algorithm)
+
+	// unknown algorithms return a typed error
+	unknown := &database.UnknownAlgorithmError{}
+
+	_, err = database.AlgorithmByID(255)
+	i.True(errors.As(err, &unknown))
+	i.Equal(byte(255), unknown.ID)
+
+	_, err = database.AlgorithmByID(internal.Unknown.ID)
+	i.True(errors.As(err, &unknown))
+
+	_, err = database.AlgorithmByName("rot13")
+	i.True(errors.As(err, &unknown))
+	i.Equal("rot13", unknown.Name)
+
+	// custom algorithms must use an unreserved ID and name, along with a cipher
+	i.True(database.RegisterAlgorithm(database.Algorithm{ID: 7, Name: "rot13", Cipher: testCipher{}}) != nil)
+	i.True(database.RegisterAlgorithm(database.Algorithm{ID: 200, Name: "", Cipher: testCipher{}}) != nil)
+	i.True(database.RegisterAlgorithm(database.Algorithm{ID: 200, Name: "rot13"}) != nil)
+	i.True(database.RegisterAlgorithm(database.Algorithm{ID: 200, Name: internal.AES_GCM.Name, Cipher: testCipher{}}) != nil)
+
+	custom := database.Algorithm{ID: 200, Name: "rot13", Cipher: testCipher{}}
+	i.NoErr(database.RegisterAlgorithm(custom))
+	i.NoErr(database.RegisterAlgorithm(custom))
+	i.True(database.RegisterAlgorithm(database.Algorithm{ID: 201, Name: "rot13", Cipher: testCipher{}}) != nil)
+	i.True(database.RegisterAlgorithm(database.Algorithm{ID: 200, Name: "rot26", Cipher: testCipher{}}) != nil)
+
+	algorithm, err = database.AlgorithmByID(200)
+	i.NoErr(err)
+	i.Equal(custom, algorithm)
+}
+
 func TestKey(t *testing.T) {
 	i := is.New(t)
 
 	i.Equal("encryption_keys", database.Key{}.TableName())
 }
+
+func TestKeyStatus(t *testing.T) {
+	i := is.New(t)
+
+	i.True(database.KeyStatus("").CanTransitionTo(database.KeyDecryptOnly))
+	i.True(database.KeyActive.CanTransitionTo(database.KeyDecryptOnly))
+	i.True(database.KeyDecryptOnly.CanTransitionTo(database.KeyActive))
+	i.True(database.KeyDecryptOnly.CanTransitionTo(database.KeyRetired))
+	i.True(database.KeyRetired.CanTransitionTo(database.KeyDecryptOnly))
+	i.True(database.KeyRetired.CanTransitionTo(database.KeyDestroyed))
+
+	i.True(!database.KeyActive.CanTransitionTo(database.KeyRetired))
+	i.True(!database.KeyActive.CanTransitionTo(database.KeyDestroyed))
+	i.True(!database.KeyDecryptOnly.CanTransitionTo(database.KeyDestroyed))
+	i.True(!database.KeyDestroyed.CanTransitionTo(database.KeyActive))
+	i.True(!database.KeyDestroyed.CanTransitionTo(database.KeyRetired))
+}
@@ -27,11 +27,36 @@ func concat(parts ...[]byte) []byte {
 	return out
 }
 
+// Flags describing how the ciphertext of a field was produced. Flags are only written when at least one is set, so
+// fields written without flags are formatted the same way they were before flags were introduced.
+const (
+	// FlagColumnAAD indicates the ciphertext is bound to the table and column it's stored in using associated data.
+	FlagColumnAAD byte = 1 << iota
+	// FlagRowAAD indicates the ciphertext is also bound to the primary key of the row it's stored in.
+	FlagRowAAD
+	// FlagGzip indicates the plaintext was compressed using gzip before it was encrypted.
+	FlagGzip
+	// FlagZstd indicates the plaintext was compressed using zstd before it was encrypted.
+	FlagZstd
+	// FlagSnappy indicates the plaintext was compressed using snappy before it was encrypted.
+	FlagSnappy
+)
+
 // FormatField takes in the various parts of the encrypted field and formats them accordingly.
 func FormatField(algorithm byte, fingerprint string, ciphertext []byte) (field []byte) {
+	return FormatFlaggedField(algorithm, 0, fingerprint, ciphertext)
+}
+
+// FormatFlaggedField formats the encrypted field, recording the provided flags alongside the algorithm.
+func FormatFlaggedField(algorithm, flags byte, fingerprint string, ciphertext []byte) (field []byte) {
+	header := []byte{algorithm}
+	if flags != 0 {
+		header = append(header, flags)
+	}
+
 	return concat(
 		encryptedFieldPrefix,
-		[]byte{algorithm},
+		header,
 		encryptedFieldDelimiter,
 		[]byte(fingerprint),
 		encryptedFieldDelimiter,
@@ -39,18 +64,37 @@ func FormatField(algorithm byte, fingerprint string, ciphertext []byte) (field [
 	)
 }
 
-// ParseField takes in the encrypted field and separates it into its various components.
+// ParseField takes in the encrypted field and separates it into its various components. Fields that aren't formatted
+// by FormatField are returned as is, with an empty fingerprint, just like plaintext values.
 func ParseField(field []byte) (algorithm byte, fingerprint string, ciphertext []byte) {
 	if !bytes.HasPrefix(field, encryptedFieldPrefix) {
 		return 0, "", field
 	}
 
-	field = bytes.TrimPrefix(field, encryptedFieldPrefix)
+	parts := bytes.SplitN(bytes.TrimPrefix(field, encryptedFieldPrefix), encryptedFieldDelimiter, 3)
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[0]) > 2 {
+		return 0, "", field
+	}
 
-	parts := bytes.SplitN(field, encryptedFieldDelimiter, 3)
 	algorithm = parts[0][0]
 	fingerprint = string(parts[1])
 	ciphertext = parts[2]
 
 	return
 }
+
+// ParseFlaggedField separates the encrypted field into its various components, including the flags recorded alongside
+// the algorithm. Fields written without flags report none.
+func ParseFlaggedField(field []byte) (algorithm, flags byte, fingerprint string, ciphertext []byte) {
+	algorithm, fingerprint, ciphertext = ParseField(field)
+	if fingerprint == "" {
+		return
+	}
+
+	header, _, _ := bytes.Cut(bytes.TrimPrefix(field, encryptedFieldPrefix), encryptedFieldDelimiter)
+	if len(header) > 1 {
+		flags = header[1]
+	}
+
+	return
+}
@@ -4,20 +4,83 @@
 package database
 
 import (
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+// KeyStatus describes where a Key is within its lifecycle.
+type KeyStatus string
+
+const (
+	// KeyActive keys can be used to encrypt new values and decrypt existing ones.
+	KeyActive KeyStatus = "active"
+	// KeyDecryptOnly keys are no longer used to encrypt new values, but can still decrypt existing ones.
+	KeyDecryptOnly KeyStatus = "decrypt-only"
+	// KeyRetired keys are not expected to protect any values. Attempts to decrypt values using a retired key fail, but
+	// the data key is kept so the key can be restored if values are found to still depend on it.
+	KeyRetired KeyStatus = "retired"
+	// KeyDestroyed keys have had their data key erased. Values protected by them can no longer be decrypted.
+	KeyDestroyed KeyStatus = "destroyed"
+)
+
+var keyTransitions = map[KeyStatus][]KeyStatus{
+	KeyActive:      {KeyDecryptOnly},
+	KeyDecryptOnly: {KeyActive, KeyRetired},
+	KeyRetired:     {KeyDecryptOnly, KeyDestroyed},
+}
+
+// CanTransitionTo returns true when a key is allowed to move from the current status to the next one. Keys without a
+// status are considered active.
+func (s KeyStatus) CanTransitionTo(next KeyStatus) bool {
+	if s == "" {
+		s = KeyActive
+	}
+
+	for _, allowed := range keyTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	// ErrKeyDestroyed is returned when attempting to decrypt a value whose key has been destroyed.
+	ErrKeyDestroyed = fmt.Errorf("encryption key has been destroyed")
+
+	// ErrKeyRetired is returned when attempting to decrypt a value whose key has been retired.
+	ErrKeyRetired = fmt.Errorf("encryption key has been retired")
+
+	// ErrInvalidTransition is returned when a key cannot be moved into the requested status.
+	ErrInvalidTransition = fmt.Errorf("invalid key status transition")
+)
+
+// TenantMismatchError is returned when attempting to decrypt a value whose key belongs to a different tenant than the
+// one associated with the context.
+type TenantMismatchError struct {
+	Fingerprint string
+	Tenant      string
+}
+
+func (e *TenantMismatchError) Error() string {
+	return fmt.Sprintf("encryption key %s does not belong to tenant %q", e.Fingerprint, e.Tenant)
+}
+
 // A Key is used to secure sensitive information within the database. This approach follows how badgerdb implemented
 // encryption. This allows data to be encrypted using a key that's different from the primary key provided at runtime.
-// When you rotate the primary key, you simply need to re-encrypt the data keys stored within the database.
+// When you rotate the primary key, you simply need to re-encrypt the data keys stored within the database. The DataKey
+// is wrapped and unwrapped using the configured KeyProvider.
 type Key struct {
 	Fingerprint string         `json:"fingerprint" gorm:"column:fingerprint;type:varchar(64);primaryKey"`
 	CreatedAt   time.Time      `json:"created_at" gorm:"column:created_at;index;autoCreateTime"`
 	UpdatedAt   time.Time      `json:"updated_at" gorm:"column:updated_at;index;autoUpdateTime"`
 	DeletedAt   gorm.DeletedAt `json:"deleted_at" gorm:"column:deleted_at;index"`
-	DataKey     []byte         `json:"data_key" gorm:"column:data_key;type:bytes;serializer:aes"`
+	Tenant      string         `json:"tenant" gorm:"column:tenant;type:varchar(64);index;default:''"`
+	Status      KeyStatus      `json:"status" gorm:"column:status;type:varchar(16);index;default:active"`
+	DataKey     []byte         `json:"data_key" gorm:"column:data_key;type:bytes"`
 }
 
 // TableName returns the name that should be used for the underlying table.
@@ -0,0 +1,22 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"time"
+)
+
+// Metadata stores small pieces of shared configuration that every process needs to agree on, such as the parameters
+// used to derive the root key from a passphrase.
+type Metadata struct {
+	Name      string    `json:"name" gorm:"column:name;type:varchar(64);primaryKey"`
+	CreatedAt time.Time `json:"created_at" gorm:"column:created_at;autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"column:updated_at;autoUpdateTime"`
+	Value     string    `json:"value" gorm:"column:value;type:varchar(255)"`
+}
+
+// TableName returns the name that should be used for the underlying table.
+func (e Metadata) TableName() string {
+	return "encryption_metadata"
+}
@@ -0,0 +1,33 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"context"
+)
+
+// KeyProvider protects the data keys stored in the encryption_keys table using a root key. Implementations may keep
+// the root key in memory or delegate to an external key management service. Wrapped keys should be formatted using
+// FormatField with the KeyID as the fingerprint so the key that wrapped them can be identified later on.
+type KeyProvider interface {
+	// KeyID returns an identifier for the root key used to wrap new data keys.
+	KeyID() string
+
+	// Wrap encrypts the provided data key using the root key.
+	Wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+
+	// Unwrap decrypts a data key previously produced by Wrap.
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// FingerprintKeyProvider is implemented by KeyProviders holding secret material that can be used to fingerprint the
+// data keys they wrap. Fingerprints are stored in plaintext, so they're computed using a keyed hash of the data key.
+// KeyProviders that don't implement this interface, such as those delegating to an external key management service,
+// fingerprint data keys using their KeyID instead.
+type FingerprintKeyProvider interface {
+	KeyProvider
+
+	// FingerprintKey returns a secret key, derived from the root key, used to fingerprint data keys.
+	FingerprintKey() []byte
+}
@@ -0,0 +1,24 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"time"
+)
+
+// A RecordKey is a data key dedicated to a single record. Values encrypted using a RecordKey can be crypto-shredded
+// individually by deleting the key, without affecting any other record in the database. Like Key, the DataKey is
+// wrapped and unwrapped using the configured KeyProvider.
+type RecordKey struct {
+	Fingerprint string    `json:"fingerprint" gorm:"column:fingerprint;type:varchar(64);primaryKey"`
+	CreatedAt   time.Time `json:"created_at" gorm:"column:created_at;index;autoCreateTime"`
+	Table       string    `json:"table" gorm:"column:table_name;type:varchar(64);index:idx_encryption_record_keys_record"`
+	RecordID    string    `json:"record_id" gorm:"column:record_id;type:varchar(64);index:idx_encryption_record_keys_record"`
+	DataKey     []byte    `json:"data_key" gorm:"column:data_key;type:bytes"`
+}
+
+// TableName returns the name that should be used for the underlying table.
+func (e RecordKey) TableName() string {
+	return "encryption_record_keys"
+}
@@ -0,0 +1,23 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package database
+
+import (
+	"time"
+)
+
+// A KeyRotation records which key replaced a previous key for a tenant. Since only one rotation can be recorded for a
+// given key, processes use it to agree on a single new key when rotating concurrently. The first key for a tenant is
+// recorded with an empty Previous fingerprint.
+type KeyRotation struct {
+	Tenant      string    `json:"tenant" gorm:"column:tenant;type:varchar(64);primaryKey"`
+	Previous    string    `json:"previous" gorm:"column:previous;type:varchar(64);primaryKey"`
+	Fingerprint string    `json:"fingerprint" gorm:"column:fingerprint;type:varchar(64)"`
+	CreatedAt   time.Time `json:"created_at" gorm:"column:created_at;autoCreateTime"`
+}
+
+// TableName returns the name that should be used for the underlying table.
+func (e KeyRotation) TableName() string {
+	return "encryption_key_rotations"
+}
@@ -21,6 +21,7 @@
 package encryption
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -31,6 +32,7 @@ import (
 	"go.pitz.tech/gorm/encryption/database"
 	"go.pitz.tech/gorm/encryption/internal"
 	"go.pitz.tech/gorm/encryption/internal/aesgcm"
+	"go.pitz.tech/gorm/encryption/sealedbox"
 )
 
 // GenerateKey produces a 256bit cryptographically secure random value. This can be used as a primary key for
@@ -39,15 +41,37 @@ func GenerateKey() ([]byte, error) {
 	return internal.GenerateKey()
 }
 
+// LocalKeyProvider returns a database.KeyProvider that wraps data keys in memory using the provided root key. This is
+// the provider used when only a key is configured. Additional decryption keys can be provided to unwrap data keys that
+// were wrapped using a previous root key.
+func LocalKeyProvider(key []byte, decryptionKeys ...[]byte) database.KeyProvider {
+	return aes.New(key, decryptionKeys...)
+}
+
 // Config provides a simplified structure for managing encryption configuration.
 type Config struct {
 	Key              []byte
+	DecryptionKeys   [][]byte
+	KeyProvider      database.KeyProvider
 	CacheSize        int
 	CacheDuration    time.Duration
 	RotationDuration time.Duration
 	Migrate          bool
 	Marshaler        func(any) ([]byte, error)
 	Unmarshaler      func([]byte, any) error
+	TenantResolver   func(ctx context.Context) string
+	Passphrase       string
+	KDFParams        KDFParams
+	Prefetch         bool
+
+	NegativeCacheDuration   time.Duration
+	DisableLookupCoalescing bool
+	Compression             string
+	CompressionThreshold    int
+	MaxDecompressedSize     int
+	UniversalDecryption     bool
+	PublicKey               []byte
+	PrivateKeys             [][]byte
 }
 
 // Apply this configuration to the provided configuration.
@@ -56,6 +80,14 @@ func (c Config) Apply(cfg *Config) {
 		cfg.Key = c.Key
 	}
 
+	if len(c.DecryptionKeys) > 0 {
+		cfg.DecryptionKeys = c.DecryptionKeys
+	}
+
+	if c.KeyProvider != nil {
+		cfg.KeyProvider = c.KeyProvider
+	}
+
 	if c.CacheSize > 0 {
 		cfg.CacheSize = c.CacheSize
 	}
@@ -79,6 +111,54 @@ func (c Config) Apply(cfg *Config) {
 	if c.Unmarshaler != nil {
 		cfg.Unmarshaler = c.Unmarshaler
 	}
+
+	if c.TenantResolver != nil {
+		cfg.TenantResolver = c.TenantResolver
+	}
+
+	if c.Passphrase != "" {
+		cfg.Passphrase = c.Passphrase
+	}
+
+	if c.KDFParams != (KDFParams{}) {
+		cfg.KDFParams = c.KDFParams
+	}
+
+	if c.Prefetch {
+		cfg.Prefetch = c.Prefetch
+	}
+
+	if c.NegativeCacheDuration != 0 {
+		cfg.NegativeCacheDuration = c.NegativeCacheDuration
+	}
+
+	if c.DisableLookupCoalescing {
+		cfg.DisableLookupCoalescing = c.DisableLookupCoalescing
+	}
+
+	if c.Compression != "" {
+		cfg.Compression = c.Compression
+	}
+
+	if c.CompressionThreshold != 0 {
+		cfg.CompressionThreshold = c.CompressionThreshold
+	}
+
+	if c.MaxDecompressedSize != 0 {
+		cfg.MaxDecompressedSize = c.MaxDecompressedSize
+	}
+
+	if c.UniversalDecryption {
+		cfg.UniversalDecryption = c.UniversalDecryption
+	}
+
+	if c.PublicKey != nil {
+		cfg.PublicKey = c.PublicKey
+	}
+
+	if len(c.PrivateKeys) > 0 {
+		cfg.PrivateKeys = c.PrivateKeys
+	}
 }
 
 // OptionFunc provides a legacy stepping stone to the new configuration.
@@ -103,6 +183,22 @@ func WithKey(key []byte) Option {
 	})
 }
 
+// WithDecryptionKeys configures additional root keys that are only used to decrypt values. This allows processes to
+// read data protected by both the old and new root key while rotating between them.
+func WithDecryptionKeys(keys ...[]byte) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.DecryptionKeys = keys
+	})
+}
+
+// WithKeyProvider configures how data keys are wrapped and unwrapped. When unset, data keys are wrapped locally using
+// the root encryption key.
+func WithKeyProvider(provider database.KeyProvider) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.KeyProvider = provider
+	})
+}
+
 // WithCacheSize configures how many data keys are cached in memory before an entry is evicted.
 func WithCacheSize(cacheSize int) Option {
 	return OptionFunc(func(cfg *Config) {
@@ -117,6 +213,23 @@ func WithCacheDuration(cacheDuration time.Duration) Option {
 	})
 }
 
+// WithNegativeCacheDuration configures how long data keys that could not be found are remembered for. This prevents
+// values referencing corrupted or foreign fingerprints from querying the database every time they're read. A negative
+// duration disables the negative cache.
+func WithNegativeCacheDuration(negativeCacheDuration time.Duration) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.NegativeCacheDuration = negativeCacheDuration
+	})
+}
+
+// WithoutLookupCoalescing disables coalescing concurrent lookups of the same data key. By default, when many goroutines
+// need a data key that isn't cached, only one of them loads it from the database while the others wait for the result.
+func WithoutLookupCoalescing() Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.DisableLookupCoalescing = true
+	})
+}
+
 // WithRotationDuration configures how long the underlying data encryption keys are valid for.
 func WithRotationDuration(rotationDuration time.Duration) Option {
 	return OptionFunc(func(cfg *Config) {
@@ -124,7 +237,8 @@ func WithRotationDuration(rotationDuration time.Duration) Option {
 	})
 }
 
-// WithMigration will automatically migrate the underlying encryption_keys schema.
+// WithMigration will automatically migrate the underlying encryption_keys, encryption_key_rotations,
+// encryption_record_keys, and encryption_metadata schemas.
 func WithMigration() Option {
 	return OptionFunc(func(cfg *Config) {
 		cfg.Migrate = true
@@ -139,38 +253,266 @@ func WithMarshaling(marshaler func(any) ([]byte, error), unmarshaler func([]byte
 	})
 }
 
-// Register enables the aes and aes-gcm serializers for the underlying Gorm database. A reference to the database is
-// needed for the aes-gcm implementation to store and read keys.
-func Register(db *gorm.DB, opts ...Option) error {
+// WithTenantResolver configures how the tenant is determined for a given request. Each tenant is given their own set
+// of data keys by the aes-gcm serializer, allowing a single tenant's keys to be rotated or destroyed independently of
+// others. Values can only be decrypted using the keys belonging to the tenant associated with the context.
+func WithTenantResolver(resolver func(ctx context.Context) string) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.TenantResolver = resolver
+	})
+}
+
+// WithPassphrase derives the root encryption key from a passphrase using Argon2id. The salt and parameters used to
+// derive the key are stored in the encryption_metadata table so every process derives the same key.
+func WithPassphrase(passphrase string) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.Passphrase = passphrase
+	})
+}
+
+// WithKDFParams configures the parameters used to derive the root key from a passphrase. The parameters are only used
+// when the root key is first derived. Afterwards, NeedsPassphraseUpgrade can be used to detect when the stored
+// parameters differ and UpgradePassphrase can be used to move to them.
+func WithKDFParams(params KDFParams) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.KDFParams = params
+	})
+}
+
+// WithKeyPrefetch replaces the query callback of the database with one that loads all data keys referenced by the
+// result of a query using a single query before any rows are deserialized. This avoids a round trip for every data key
+// missing from the cache when loading many rows, at the cost of buffering the raw result of queries against models
+// containing aes-gcm fields in memory, up to 1000 rows at a time. Register returns an error when gorm's query callback
+// has already been replaced by another plugin.
+func WithKeyPrefetch() Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.Prefetch = true
+	})
+}
+
+// WithCompression compresses values before they're encrypted by the serializers using data keys, using gzip, zstd, or
+// snappy. Encrypted values cannot be compressed by the database, so this can greatly reduce the storage used by large
+// values such as marshaled structures. Individual fields can select a different algorithm (or none) using the compress
+// tag setting. Values written with and without compression can be read regardless of how the field is configured.
+//
+// Compression leaks information about the plaintext through the length of the ciphertext, since values compress
+// differently depending on their content. When attackers can influence part of a value and observe the size of what's
+// stored, they can recover the rest of it, just as the CRIME and BREACH attacks do. Avoid compressing fields mixing
+// secrets with input controlled by someone else, using "compress:none" to disable compression for them.
+func WithCompression(algorithm string) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.Compression = algorithm
+	})
+}
+
+// WithCompressionThreshold configures how large a value must be, in bytes, before it's compressed. Every value is
+// compressed when the threshold is zero or negative.
+func WithCompressionThreshold(threshold int) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.CompressionThreshold = threshold
+	})
+}
+
+// WithMaxDecompressedSize configures the largest size, in bytes, a compressed value may grow to when it's read. Values
+// exceeding it fail to be decrypted rather than exhausting memory. A negative size allows values of any size.
+func WithMaxDecompressedSize(size int) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.MaxDecompressedSize = size
+	})
+}
+
+// WithUniversalDecryption allows each registered serializer to read values written by any supported algorithm, using
+// the algorithm that wrote them, while new values are still written using the serializer's own algorithm. This allows
+// the serializer tag of a column to be changed without re-encrypting it first. Columns migrate lazily as rows are
+// rewritten, or can be migrated eagerly using Reencrypt.
+func WithUniversalDecryption() Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.UniversalDecryption = true
+	})
+}
+
+// WithPublicKey enables the sealed-box serializer, which encrypts values using the provided X25519 public key. See
+// RegisterSealedBox for processes that only write values and hold no other keys.
+func WithPublicKey(publicKey []byte) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.PublicKey = publicKey
+	})
+}
+
+// WithPrivateKeys enables the sealed-box serializer, allowing values encrypted using the public half of any of the
+// provided X25519 private keys to be read. Unless a public key is provided, new values are encrypted using the public
+// half of the first private key.
+func WithPrivateKeys(keys ...[]byte) Option {
+	return OptionFunc(func(cfg *Config) {
+		cfg.PrivateKeys = keys
+	})
+}
+
+// Register enables the aes, aes-gcm, chacha20poly1305, xchacha20poly1305, aes-gcm-stream, and aes-gcm-record
+// serializers for the underlying Gorm database. A reference to the database is needed for the implementations using
+// data keys to store and read keys. The aes-gcm, chacha20poly1305, xchacha20poly1305, and aes-gcm-stream serializers
+// share the same data keys. The aes-gcm-record serializer also registers callbacks on the database to manage the keys
+// for each record. The sealed-box serializer is enabled when a public or private key is configured. When universal
+// decryption is enabled, each serializer can read values written by any of the others. The returned Manager can be used
+// to rotate keys on demand, stream large values, report usage, and release keys held in memory on shutdown.
+func Register(db *gorm.DB, opts ...Option) (*Manager, error) {
 	cfg := &Config{
 		CacheSize:        5,
 		CacheDuration:    5 * time.Minute,
 		RotationDuration: 10 * 24 * time.Hour,
 		Marshaler:        NoMarshaler,
 		Unmarshaler:      NoUnmarshaler,
+		KDFParams:        DefaultKDFParams,
+
+		NegativeCacheDuration: 30 * time.Second,
+		CompressionThreshold:  256,
+		MaxDecompressedSize:   64 << 20,
 	}
 
 	for _, opt := range opts {
 		opt.Apply(cfg)
 	}
 
-	schema.RegisterSerializer(internal.AES.Name, aes.New(cfg.Key))
-
 	if cfg.Migrate {
-		err := db.AutoMigrate(database.Key{})
+		err := db.AutoMigrate(database.Key{}, database.KeyRotation{}, database.RecordKey{}, database.Metadata{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Passphrase != "" {
+		if cfg.Key != nil {
+			return nil, fmt.Errorf("a key and passphrase cannot both be configured")
+		}
+
+		key, decryptionKeys, err := passphraseKeys(context.Background(), db, cfg.Passphrase, cfg.KDFParams)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Key = key
+		cfg.DecryptionKeys = append(cfg.DecryptionKeys, decryptionKeys...)
+	}
+
+	if cfg.KeyProvider == nil {
+		cfg.KeyProvider = LocalKeyProvider(cfg.Key, cfg.DecryptionKeys...)
+	}
+
+	aesSerializer := aes.New(cfg.Key, cfg.DecryptionKeys...)
+
+	compression := aesgcm.Compression{
+		Algorithm: cfg.Compression,
+		Threshold: cfg.CompressionThreshold,
+		MaxSize:   cfg.MaxDecompressedSize,
+	}
+
+	serializer, err := aesgcm.New(
+		db,
+		cfg.KeyProvider,
+		cfg.CacheSize,
+		cfg.CacheDuration,
+		cfg.NegativeCacheDuration,
+		!cfg.DisableLookupCoalescing,
+		cfg.RotationDuration,
+		compression,
+		cfg.Marshaler,
+		cfg.Unmarshaler,
+		cfg.TenantResolver,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = serializer.RegisterCallbacks(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Prefetch {
+		err = serializer.RegisterPrefetch(db)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	serializer, err := aesgcm.New(db, cfg.Key, cfg.CacheSize, cfg.CacheDuration, cfg.RotationDuration, cfg.Marshaler, cfg.Unmarshaler)
+	recordSerializer := aesgcm.NewRecord(db, cfg.KeyProvider, compression, cfg.Marshaler, cfg.Unmarshaler)
+
+	err = recordSerializer.RegisterCallbacks(db)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	schema.RegisterSerializer(internal.AES_GCM.Name, serializer)
+	serializers := map[string]schema.SerializerInterface{
+		internal.AES.Name:            aesSerializer,
+		internal.AES_GCM.Name:        serializer,
+		internal.AES_GCM_RECORD.Name: recordSerializer,
+	}
+
+	for _, algorithm := range []internal.Algorithm{
+		internal.CHACHA20_POLY1305,
+		internal.XCHACHA20_POLY1305,
+		internal.AES_GCM_STREAM,
+	} {
+		variant, err := serializer.WithAlgorithm(algorithm.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		serializers[algorithm.Name] = variant
+	}
+
+	var sealedBoxSerializer *sealedbox.Serializer
+	if cfg.PublicKey != nil || len(cfg.PrivateKeys) > 0 {
+		sealedBoxSerializer, err = sealedbox.New(cfg.PublicKey, cfg.PrivateKeys...)
+		if err != nil {
+			return nil, err
+		}
+
+		serializers[internal.SEALED_BOX.Name] = sealedBoxSerializer
+	}
+
+	if cfg.UniversalDecryption {
+		// the dispatcher uses the serializers without a fallback, so values no serializer can read return an error
+		dispatcher := algorithmDispatcher{
+			internal.AES.ID:                aesSerializer,
+			internal.AES_SIV.ID:            aesSerializer,
+			internal.AES_GCM.ID:            serializer,
+			internal.CHACHA20_POLY1305.ID:  serializer,
+			internal.XCHACHA20_POLY1305.ID: serializer,
+			internal.AES_GCM_STREAM.ID:     serializer,
+			internal.AES_GCM_RECORD.ID:     recordSerializer,
+		}
+
+		if sealedBoxSerializer != nil {
+			dispatcher[internal.SEALED_BOX.ID] = sealedBoxSerializer
+		}
+
+		for name, registered := range serializers {
+			switch registered := registered.(type) {
+			case *aes.Serializer:
+				serializers[name] = registered.WithFallback(dispatcher)
+			case *aesgcm.Serializer:
+				serializers[name] = registered.WithFallback(dispatcher)
+			case *aesgcm.RecordSerializer:
+				serializers[name] = registered.WithFallback(dispatcher)
+			case *sealedbox.Serializer:
+				serializers[name] = registered.WithFallback(dispatcher)
+			}
+		}
+	}
+
+	for name, registered := range serializers {
+		schema.RegisterSerializer(name, registered)
+	}
 
-	return nil
+	return &Manager{
+		db:                  db,
+		prefetch:            cfg.Prefetch,
+		aesSerializer:       aesSerializer,
+		serializer:          serializer,
+		recordSerializer:    recordSerializer,
+		sealedBoxSerializer: sealedBoxSerializer,
+	}, nil
 }
 
 // ErrMarshaling is returned when no marshaler or unmarshaler are specified for the config.
@@ -26,33 +26,72 @@ func TestConfigMerge(t *testing.T) {
 
 	base := encryption.Config{}
 	i.Equal(nil, base.Key)
+	i.Equal(0, len(base.DecryptionKeys))
+	i.Equal(nil, base.KeyProvider)
 	i.Equal(0, base.CacheSize)
 	i.Equal(time.Duration(0), base.CacheDuration)
 	i.Equal(time.Duration(0), base.RotationDuration)
 	i.Equal(false, base.Migrate)
 	i.Equal(nil, base.Marshaler)
 	i.Equal(nil, base.Unmarshaler)
+	i.Equal("", base.Passphrase)
+	i.Equal(encryption.KDFParams{}, base.KDFParams)
+	i.Equal(false, base.Prefetch)
+	i.Equal(time.Duration(0), base.NegativeCacheDuration)
+	i.Equal(false, base.DisableLookupCoalescing)
+	i.Equal("", base.Compression)
+	i.Equal(0, base.CompressionThreshold)
+	i.Equal(false, base.UniversalDecryption)
+	i.Equal(nil, base.PublicKey)
+	i.Equal(0, len(base.PrivateKeys))
 
 	key, err := encryption.GenerateKey()
 	i.NoErr(err)
 
+	provider := encryption.LocalKeyProvider(key)
+
 	encryption.Config{
 		Key:              key,
+		DecryptionKeys:   [][]byte{key},
+		KeyProvider:      provider,
 		CacheSize:        100,
 		CacheDuration:    time.Minute,
 		RotationDuration: time.Hour,
 		Migrate:          true,
 		Marshaler:        json.Marshal,
 		Unmarshaler:      json.Unmarshal,
+		Passphrase:       "passphrase",
+		KDFParams:        encryption.DefaultKDFParams,
+		Prefetch:         true,
+
+		NegativeCacheDuration:   -1,
+		DisableLookupCoalescing: true,
+		Compression:             "zstd",
+		CompressionThreshold:    64,
+		UniversalDecryption:     true,
+		PublicKey:               key,
+		PrivateKeys:             [][]byte{key},
 	}.Apply(&base)
 
 	i.Equal(key, base.Key)
+	i.Equal([][]byte{key}, base.DecryptionKeys)
+	i.Equal(provider, base.KeyProvider)
 	i.Equal(100, base.CacheSize)
 	i.Equal(time.Minute, base.CacheDuration)
 	i.Equal(time.Hour, base.RotationDuration)
 	i.Equal(true, base.Migrate)
 	i.Equal(json.Marshal, base.Marshaler)
 	i.Equal(json.Unmarshal, base.Unmarshaler)
+	i.Equal("passphrase", base.Passphrase)
+	i.Equal(encryption.DefaultKDFParams, base.KDFParams)
+	i.Equal(true, base.Prefetch)
+	i.Equal(time.Duration(-1), base.NegativeCacheDuration)
+	i.Equal(true, base.DisableLookupCoalescing)
+	i.Equal("zstd", base.Compression)
+	i.Equal(64, base.CompressionThreshold)
+	i.Equal(true, base.UniversalDecryption)
+	i.Equal(key, base.PublicKey)
+	i.Equal([][]byte{key}, base.PrivateKeys)
 }
 
 func TestConfigOptions(t *testing.T) {
@@ -60,6 +99,8 @@ func TestConfigOptions(t *testing.T) {
 
 	base := encryption.Config{}
 	i.Equal(nil, base.Key)
+	i.Equal(0, len(base.DecryptionKeys))
+	i.Equal(nil, base.KeyProvider)
 	i.Equal(0, base.CacheSize)
 	i.Equal(time.Duration(0), base.CacheDuration)
 	i.Equal(time.Duration(0), base.RotationDuration)
@@ -73,6 +114,13 @@ func TestConfigOptions(t *testing.T) {
 	encryption.WithKey(key).Apply(&base)
 	i.Equal(key, base.Key)
 
+	encryption.WithDecryptionKeys(key).Apply(&base)
+	i.Equal([][]byte{key}, base.DecryptionKeys)
+
+	provider := encryption.LocalKeyProvider(key)
+	encryption.WithKeyProvider(provider).Apply(&base)
+	i.Equal(provider, base.KeyProvider)
+
 	encryption.WithCacheSize(100).Apply(&base)
 	i.Equal(100, base.CacheSize)
 
@@ -88,6 +136,36 @@ func TestConfigOptions(t *testing.T) {
 	encryption.WithMarshaling(json.Marshal, json.Unmarshal).Apply(&base)
 	i.Equal(json.Marshal, base.Marshaler)
 	i.Equal(json.Unmarshal, base.Unmarshaler)
+
+	encryption.WithPassphrase("passphrase").Apply(&base)
+	i.Equal("passphrase", base.Passphrase)
+
+	encryption.WithKDFParams(encryption.DefaultKDFParams).Apply(&base)
+	i.Equal(encryption.DefaultKDFParams, base.KDFParams)
+
+	encryption.WithKeyPrefetch().Apply(&base)
+	i.Equal(true, base.Prefetch)
+
+	encryption.WithNegativeCacheDuration(time.Second).Apply(&base)
+	i.Equal(time.Second, base.NegativeCacheDuration)
+
+	encryption.WithoutLookupCoalescing().Apply(&base)
+	i.Equal(true, base.DisableLookupCoalescing)
+
+	encryption.WithCompression("snappy").Apply(&base)
+	i.Equal("snappy", base.Compression)
+
+	encryption.WithCompressionThreshold(64).Apply(&base)
+	i.Equal(64, base.CompressionThreshold)
+
+	encryption.WithUniversalDecryption().Apply(&base)
+	i.Equal(true, base.UniversalDecryption)
+
+	encryption.WithPublicKey(key).Apply(&base)
+	i.Equal(key, base.PublicKey)
+
+	encryption.WithPrivateKeys(key).Apply(&base)
+	i.Equal([][]byte{key}, base.PrivateKeys)
 }
 
 func TestMarshaling(t *testing.T) {
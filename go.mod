@@ -1,14 +1,18 @@
 module go.pitz.tech/gorm/encryption
 
-go 1.19
+go 1.22
 
 require (
 	github.com/hashicorp/golang-lru/v2 v2.0.7
+	github.com/klauspost/compress v1.18.0
 	github.com/matryer/is v1.4.1
+	golang.org/x/crypto v0.14.0
+	golang.org/x/sync v0.4.0
 	gorm.io/gorm v1.25.5
 )
 
 require (
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
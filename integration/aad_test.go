@@ -0,0 +1,211 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testAADRecord struct {
+	ID     int    `gorm:"primaryKey;autoIncrement"`
+	SSN    []byte `gorm:"type:bytes;serializer:aes-gcm;aad"`
+	Other  []byte `gorm:"type:bytes;serializer:xchacha20poly1305;aad"`
+	Column []byte `gorm:"type:bytes;serializer:aes-gcm;aad:column"`
+	Legacy []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Strict []byte `gorm:"type:bytes;serializer:aes-gcm;aad:required"`
+}
+
+func TestAssociatedData(t *testing.T) {
+	is := is.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:aad?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testAADRecord{})
+	is.NoErr(err)
+
+	for _, id := range []int{1, 2} {
+		err = db.Create(&testAADRecord{
+			ID:     id,
+			SSN:    []byte("ssn"),
+			Other:  []byte("other"),
+			Column: []byte("column"),
+			Legacy: []byte("legacy"),
+			Strict: []byte("strict"),
+		}).Error
+		is.NoErr(err)
+	}
+
+	raw := func(id int, column string) []byte {
+		value := make([]byte, 0)
+		err := db.Table("test_aad_records").Select(column).Where("id = ?", id).Row().Scan(&value)
+		is.NoErr(err)
+
+		return value
+	}
+
+	flags := func(value []byte) byte {
+		_, flags, _, _ := database.ParseFlaggedField(value)
+		return flags
+	}
+
+	is.Equal(database.FlagColumnAAD|database.FlagRowAAD, flags(raw(1, "ssn")))
+	is.Equal(database.FlagColumnAAD|database.FlagRowAAD, flags(raw(1, "other")))
+	is.Equal(database.FlagColumnAAD, flags(raw(1, "column")))
+	is.Equal(byte(0), flags(raw(1, "legacy")))
+	is.Equal(database.FlagColumnAAD|database.FlagRowAAD, flags(raw(1, "strict")))
+
+	decoded := &testAADRecord{}
+	err = db.First(decoded, 2).Error
+	is.NoErr(err)
+	is.Equal("ssn", string(decoded.SSN))
+	is.Equal("other", string(decoded.Other))
+	is.Equal("column", string(decoded.Column))
+	is.Equal("legacy", string(decoded.Legacy))
+	is.Equal("strict", string(decoded.Strict))
+
+	copyValue := func(from, to int, fromColumn, toColumn string) error {
+		err := db.Table("test_aad_records").Where("id = ?", to).UpdateColumn(toColumn, raw(from, fromColumn)).Error
+		is.NoErr(err)
+
+		return db.Select("id", toColumn).First(&testAADRecord{}, to).Error
+	}
+
+	// values bound to their row cannot be copied into another row
+	is.True(copyValue(1, 2, "ssn", "ssn") != nil)
+
+	// or into another column of the same row
+	is.True(copyValue(1, 1, "other", "ssn") != nil)
+
+	// values written without associated data continue to open, even after the field is tagged
+	is.NoErr(copyValue(1, 2, "legacy", "legacy"))
+	is.NoErr(copyValue(1, 2, "legacy", "column"))
+
+	// values only bound to their column can be copied between rows, but not between columns
+	is.NoErr(copyValue(1, 2, "column", "column"))
+	is.True(copyValue(1, 1, "column", "legacy") != nil)
+
+	// fields requiring associated data reject values written without it, including plaintext
+	is.True(copyValue(1, 2, "legacy", "strict") != nil)
+	is.True(copyValue(1, 2, "column", "strict") != nil)
+
+	err = db.Table("test_aad_records").Where("id = ?", 2).UpdateColumn("strict", []byte("plaintext")).Error
+	is.NoErr(err)
+	is.True(db.Select("id", "strict").First(&testAADRecord{}, 2).Error != nil)
+
+	// along with values that cannot be bound to their row
+	err = db.Model(&testAADRecord{}).Where("id = ?", 2).Updates(&testAADRecord{Strict: []byte("strict")}).Error
+	is.True(err != nil)
+
+	// rows are bound to the primary key assigned by the database once they're created
+	created := &testAADRecord{SSN: []byte("ssn"), Strict: []byte("strict")}
+	err = db.Create(created).Error
+	is.NoErr(err)
+	is.Equal(database.FlagColumnAAD|database.FlagRowAAD, flags(raw(created.ID, "ssn")))
+	is.Equal(database.FlagColumnAAD|database.FlagRowAAD, flags(raw(created.ID, "strict")))
+
+	batch := []*testAADRecord{{SSN: []byte("first")}, {SSN: []byte("second")}}
+	err = db.Create(batch).Error
+	is.NoErr(err)
+
+	for _, record := range batch {
+		is.Equal(database.FlagColumnAAD|database.FlagRowAAD, flags(raw(record.ID, "ssn")))
+
+		decoded = &testAADRecord{}
+		err = db.First(decoded, record.ID).Error
+		is.NoErr(err)
+		is.Equal(string(record.SSN), string(decoded.SSN))
+	}
+
+	// values bound to their row can only be read along with the primary key
+	err = db.Select("ssn").First(&testAADRecord{}, created.ID).Error
+	is.True(err != nil)
+
+	decoded = &testAADRecord{}
+	err = db.Select("id", "ssn").First(decoded, created.ID).Error
+	is.NoErr(err)
+	is.Equal("ssn", string(decoded.SSN))
+}
+
+type testRecordAADRecord struct {
+	ID     int    `gorm:"primaryKey;autoIncrement"`
+	SSN    []byte `gorm:"type:bytes;serializer:aes-gcm-record;aad"`
+	Other  []byte `gorm:"type:bytes;serializer:aes-gcm-record;aad"`
+	Legacy []byte `gorm:"type:bytes;serializer:aes-gcm-record"`
+}
+
+func TestRecordAssociatedData(t *testing.T) {
+	is := is.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:record_aad?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testRecordAADRecord{})
+	is.NoErr(err)
+
+	records := []*testRecordAADRecord{
+		{SSN: []byte("first"), Other: []byte("other"), Legacy: []byte("legacy")},
+		{SSN: []byte("second"), Other: []byte("other"), Legacy: []byte("legacy")},
+	}
+
+	// rows are bound to the primary key assigned by the database once they're created
+	for _, record := range records {
+		err = db.Create(record).Error
+		is.NoErr(err)
+	}
+
+	raw := func(id int, column string) []byte {
+		value := make([]byte, 0)
+		err := db.Table("test_record_aad_records").Select(column).Where("id = ?", id).Row().Scan(&value)
+		is.NoErr(err)
+
+		return value
+	}
+
+	flags := func(value []byte) byte {
+		_, flags, _, _ := database.ParseFlaggedField(value)
+		return flags
+	}
+
+	is.Equal(database.FlagColumnAAD|database.FlagRowAAD, flags(raw(records[0].ID, "ssn")))
+	is.Equal(byte(0), flags(raw(records[0].ID, "legacy")))
+
+	decoded := &testRecordAADRecord{}
+	err = db.First(decoded, records[1].ID).Error
+	is.NoErr(err)
+	is.Equal("second", string(decoded.SSN))
+	is.Equal("other", string(decoded.Other))
+
+	copyValue := func(from, to int, fromColumn, toColumn string) error {
+		err := db.Table("test_record_aad_records").Where("id = ?", to).UpdateColumn(toColumn, raw(from, fromColumn)).Error
+		is.NoErr(err)
+
+		return db.First(&testRecordAADRecord{}, to).Error
+	}
+
+	// values bound to their row cannot be copied into another row
+	is.True(copyValue(records[0].ID, records[1].ID, "ssn", "ssn") != nil)
+
+	// or into another column of the same row
+	is.True(copyValue(records[0].ID, records[0].ID, "other", "ssn") != nil)
+}
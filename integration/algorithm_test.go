@@ -0,0 +1,143 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+// xorCipher is a toy cipher used to exercise application provided algorithms. It provides no security whatsoever.
+type xorCipher byte
+
+func (c xorCipher) xor(data []byte) []byte {
+	out := make([]byte, len(data))
+	for idx := range data {
+		out[idx] = data[idx] ^ byte(c)
+	}
+
+	return out
+}
+
+func (c xorCipher) Encrypt(_ context.Context, plaintext []byte) (string, []byte, error) {
+	return "xor", c.xor(plaintext), nil
+}
+
+func (c xorCipher) Decrypt(_ context.Context, fingerprint string, ciphertext []byte) ([]byte, error) {
+	if fingerprint != "xor" {
+		return nil, errors.New("unknown key")
+	}
+
+	return c.xor(ciphertext), nil
+}
+
+// commaCipher returns fingerprints that cannot be stored in the field format.
+type commaCipher struct {
+	xorCipher
+}
+
+func (c commaCipher) Encrypt(_ context.Context, plaintext []byte) (string, []byte, error) {
+	return "x,or", c.xor(plaintext), nil
+}
+
+type testAlgorithmRecord struct {
+	ID     int    `gorm:"primaryKey;autoIncrement"`
+	Custom []byte `gorm:"type:bytes;serializer:xor"`
+	Value  []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+type testCommaRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Comma []byte `gorm:"type:bytes;serializer:comma"`
+}
+
+func TestCustomAlgorithm(t *testing.T) {
+	is := is.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:algorithm?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = encryption.RegisterAlgorithm(database.Algorithm{ID: 200, Name: "xor", Cipher: xorCipher(0x5a)})
+	is.NoErr(err)
+
+	// built-in algorithms cannot be replaced
+	err = encryption.RegisterAlgorithm(database.Algorithm{ID: 2, Name: "aes-gcm", Cipher: xorCipher(0x5a)})
+	is.True(err != nil)
+
+	// nor can any other serializer
+	err = encryption.RegisterAlgorithm(database.Algorithm{ID: 201, Name: "json", Cipher: xorCipher(0x5a)})
+	is.True(err != nil)
+
+	_, err = database.AlgorithmByName("json")
+	is.True(err != nil)
+
+	err = encryption.RegisterAlgorithm(database.Algorithm{ID: 202, Name: "comma", Cipher: commaCipher{xorCipher(0x5a)}})
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testAlgorithmRecord{}, testCommaRecord{})
+	is.NoErr(err)
+
+	record := &testAlgorithmRecord{Custom: []byte("custom"), Value: []byte("value")}
+	err = db.Create(record).Error
+	is.NoErr(err)
+
+	raw := func(column string) []byte {
+		value := make([]byte, 0)
+		err := db.Table("test_algorithm_records").Select(column).Where("id = ?", record.ID).Row().Scan(&value)
+		is.NoErr(err)
+
+		return value
+	}
+
+	algorithm, fingerprint, _ := database.ParseField(raw("custom"))
+	is.Equal(byte(200), algorithm)
+	is.Equal("xor", fingerprint)
+
+	decoded := &testAlgorithmRecord{}
+	err = db.First(decoded, record.ID).Error
+	is.NoErr(err)
+	is.Equal("custom", string(decoded.Custom))
+	is.Equal("value", string(decoded.Value))
+
+	update := func(column string, value []byte) error {
+		err := db.Table("test_algorithm_records").Where("id = ?", record.ID).UpdateColumn(column, value).Error
+		is.NoErr(err)
+
+		return db.Select("id", column).First(&testAlgorithmRecord{}, record.ID).Error
+	}
+
+	// values written using another registered algorithm report which one was used
+	err = update("value", raw("custom"))
+	is.True(err != nil)
+
+	unknown := &database.UnknownAlgorithmError{}
+	is.True(!errors.As(err, &unknown))
+
+	// values written using an unknown algorithm return a typed error rather than panicking
+	err = update("value", database.FormatField(250, "fingerprint", []byte("ciphertext")))
+	is.True(errors.As(err, &unknown))
+	is.Equal(byte(250), unknown.ID)
+
+	err = update("custom", database.FormatField(127, "fingerprint", []byte("ciphertext")))
+	is.True(errors.As(err, &unknown))
+	is.Equal(byte(127), unknown.ID)
+
+	// fingerprints cannot contain the separator used by the field format
+	err = db.Create(&testCommaRecord{Comma: []byte("comma")}).Error
+	is.True(err != nil)
+}
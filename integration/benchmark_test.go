@@ -0,0 +1,183 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption"
+)
+
+// discardPool is a gorm.ConnPool that serializes the arguments of each statement before discarding it. This keeps the
+// database from becoming the bottleneck when measuring the cost of encrypting values.
+type discardPool struct{}
+
+func (discardPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (discardPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	for _, arg := range args {
+		if valuer, ok := arg.(driver.Valuer); ok {
+			if _, err := valuer.Value(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return driver.RowsAffected(len(args)), nil
+}
+
+func (discardPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (discardPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+type benchmarkRecord struct {
+	ID    string `gorm:"primaryKey"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Other []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+type benchmarkFields struct {
+	Value   []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	ChaCha  []byte `gorm:"type:bytes;serializer:chacha20poly1305"`
+	XChaCha []byte `gorm:"type:bytes;serializer:xchacha20poly1305"`
+}
+
+func BenchmarkSerializers(b *testing.B) {
+	is := is.New(b)
+	ctx := context.Background()
+
+	dsn := fmt.Sprintf("file:benchmark-%d?mode=memory&cache=shared", time.Now().UnixNano())
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	manager, err := encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+	defer manager.Close()
+
+	sch, err := schema.Parse(&benchmarkFields{}, &sync.Map{}, schema.NamingStrategy{})
+	is.NoErr(err)
+
+	fields := map[string]*schema.Field{
+		"aes-gcm":           sch.LookUpField("value"),
+		"chacha20poly1305":  sch.LookUpField("ChaCha"),
+		"xchacha20poly1305": sch.LookUpField("XChaCha"),
+	}
+
+	sizes := map[string]int{
+		"small": 32,
+		"large": 64 * 1024,
+	}
+
+	for algorithm, field := range fields {
+		benchmarkSerializer(b, ctx, algorithm, field, sizes)
+	}
+}
+
+func benchmarkSerializer(b *testing.B, ctx context.Context, algorithm string, field *schema.Field, sizes map[string]int) {
+	is := is.New(b)
+
+	for name, size := range sizes {
+		plaintext := make([]byte, size)
+
+		value, err := field.Serializer.Value(ctx, field, reflect.Value{}, plaintext)
+		is.NoErr(err)
+
+		b.Run(algorithm+"/Value/"+name, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			for n := 0; n < b.N; n++ {
+				_, err := field.Serializer.Value(ctx, field, reflect.Value{}, plaintext)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(algorithm+"/Scan/"+name, func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			record := &benchmarkFields{}
+
+			for n := 0; n < b.N; n++ {
+				err := field.Serializer.Scan(ctx, field, reflect.ValueOf(record), value)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCreateInBatchesParallel(b *testing.B) {
+	is := is.New(b)
+
+	// benchmarks are run multiple times, so each run is given its own database
+	dsn := fmt.Sprintf("file:benchmark-%d?mode=memory&cache=shared", time.Now().UnixNano())
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	manager, err := encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+	defer manager.Close()
+
+	value := []byte("the quick brown fox jumps over the lazy dog")
+	id := int64(0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		discard := db.Session(&gorm.Session{SkipDefaultTransaction: true})
+		discard.Statement.ConnPool = discardPool{}
+
+		records := make([]*benchmarkRecord, 0, 100)
+
+		for pb.Next() {
+			records = records[:0]
+			for idx := 0; idx < cap(records); idx++ {
+				records = append(records, &benchmarkRecord{
+					ID:    strconv.FormatInt(atomic.AddInt64(&id, 1), 10),
+					Value: value,
+					Other: value,
+				})
+			}
+
+			err := discard.CreateInBatches(records, 50).Error
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testChaChaRecord struct {
+	ID       int    `gorm:"primaryKey;autoIncrement"`
+	AESGCM   []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	ChaCha   []byte `gorm:"type:bytes;serializer:chacha20poly1305"`
+	XChaCha  []byte `gorm:"type:bytes;serializer:xchacha20poly1305"`
+	Migrated []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+// testChaChaMigratedRecord moves the migrated column of testChaChaRecord to xchacha20poly1305.
+type testChaChaMigratedRecord struct {
+	ID       int    `gorm:"primaryKey;autoIncrement"`
+	Migrated []byte `gorm:"type:bytes;serializer:xchacha20poly1305"`
+}
+
+func (testChaChaMigratedRecord) TableName() string {
+	return "test_cha_cha_records"
+}
+
+func TestChaCha20Poly1305(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:chacha?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testChaChaRecord{})
+	is.NoErr(err)
+
+	record := &testChaChaRecord{
+		AESGCM:   []byte("aes-gcm"),
+		ChaCha:   []byte("chacha20poly1305"),
+		XChaCha:  []byte("xchacha20poly1305"),
+		Migrated: []byte("migrated"),
+	}
+
+	err = db.Create(record).Error
+	is.NoErr(err)
+
+	decoded := &testChaChaRecord{}
+	err = db.First(decoded, record.ID).Error
+	is.NoErr(err)
+	is.Equal(record, decoded)
+
+	// every algorithm uses the same data key, recording which algorithm was used in the field
+	values := make([][]byte, 3)
+	err = db.Table("test_cha_cha_records").Select("aesgcm, cha_cha, x_cha_cha").Where("id = ?", record.ID).Row().Scan(&values[0], &values[1], &values[2])
+	is.NoErr(err)
+
+	algorithms := make([]byte, 0, len(values))
+	fingerprints := make(map[string]bool)
+
+	for _, value := range values {
+		algorithm, fingerprint, ciphertext := database.ParseField(value)
+		is.True(len(ciphertext) > 0)
+
+		algorithms = append(algorithms, algorithm)
+		fingerprints[fingerprint] = true
+	}
+
+	is.Equal(1, len(fingerprints))
+	is.True(algorithms[0] != algorithms[1] && algorithms[1] != algorithms[2] && algorithms[0] != algorithms[2])
+
+	_, fingerprint, _ := database.ParseField(values[0])
+
+	// columns can be moved between algorithms sharing the same data keys
+	remaining, err := encryption.CountRemaining(ctx, db, testChaChaMigratedRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(map[string]int64{fingerprint: 1}, remaining)
+
+	err = encryption.Reencrypt(ctx, db, testChaChaMigratedRecord{}, nil)
+	is.NoErr(err)
+
+	remaining, err = encryption.CountRemaining(ctx, db, testChaChaMigratedRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(0, len(remaining))
+
+	migrated := make([]byte, 0)
+	err = db.Table("test_cha_cha_records").Select("migrated").Where("id = ?", record.ID).Row().Scan(&migrated)
+	is.NoErr(err)
+
+	algorithm, _, _ := database.ParseField(migrated)
+	is.Equal(algorithms[2], algorithm)
+
+	// values written using any of the algorithms remain readable by the others
+	decoded = &testChaChaRecord{}
+	err = db.First(decoded, record.ID).Error
+	is.NoErr(err)
+	is.Equal("migrated", string(decoded.Migrated))
+}
@@ -49,7 +49,7 @@ func test(is *is.I, db *gorm.DB) {
 	is.NoErr(err)
 
 	// setup encryption
-	err = encryption.Register(db,
+	_, err = encryption.Register(db,
 		encryption.WithKey(key),
 		encryption.WithMigration(),
 		encryption.WithMarshaling(json.Marshal, json.Unmarshal),
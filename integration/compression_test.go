@@ -0,0 +1,190 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testCompressionRecord struct {
+	ID     int    `gorm:"primaryKey;autoIncrement"`
+	Blob   []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Small  []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Zstd   []byte `gorm:"type:bytes;serializer:aes-gcm;compress:zstd"`
+	Snappy []byte `gorm:"type:bytes;serializer:xchacha20poly1305;compress:snappy"`
+	None   []byte `gorm:"type:bytes;serializer:aes-gcm;compress:none"`
+	Record []byte `gorm:"type:bytes;serializer:aes-gcm-record;compress"`
+}
+
+func TestCompression(t *testing.T) {
+	is := is.New(t)
+
+	dsn := "file:compression?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration(), encryption.WithCompression("gzip"))
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testCompressionRecord{})
+	is.NoErr(err)
+
+	blob := bytes.Repeat([]byte(`{"field":"a large, repetitive json blob"},`), 100)
+	small := []byte(`{"field":"small"}`)
+
+	expected := testCompressionRecord{
+		Blob:   blob,
+		Small:  small,
+		Zstd:   blob,
+		Snappy: blob,
+		None:   blob,
+		Record: blob,
+	}
+
+	record := expected
+	err = db.Create(&record).Error
+	is.NoErr(err)
+
+	raw := func(id int, column string) []byte {
+		value := make([]byte, 0)
+		err := db.Table("test_compression_records").Select(column).Where("id = ?", id).Row().Scan(&value)
+		is.NoErr(err)
+
+		return value
+	}
+
+	flags := func(value []byte) byte {
+		_, flags, _, _ := database.ParseFlaggedField(value)
+		return flags
+	}
+
+	is.Equal(database.FlagGzip, flags(raw(record.ID, "blob")))
+	is.Equal(database.FlagZstd, flags(raw(record.ID, "zstd")))
+	is.Equal(database.FlagSnappy, flags(raw(record.ID, "snappy")))
+	is.Equal(database.FlagGzip, flags(raw(record.ID, "record")))
+
+	for _, column := range []string{"blob", "zstd", "snappy", "record"} {
+		is.True(len(raw(record.ID, column)) < len(blob))
+	}
+
+	// values smaller than the threshold, or fields opting out, aren't compressed
+	is.Equal(byte(0), flags(raw(record.ID, "small")))
+	is.Equal(byte(0), flags(raw(record.ID, "none")))
+	is.True(len(raw(record.ID, "none")) > len(blob))
+
+	decoded := testCompressionRecord{}
+	err = db.First(&decoded, record.ID).Error
+	is.NoErr(err)
+
+	expected.ID = record.ID
+	is.Equal(expected, decoded)
+
+	// compressed and uncompressed values can live side by side
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key))
+	is.NoErr(err)
+
+	uncompressed := testCompressionRecord{Blob: blob}
+	err = db.Create(&uncompressed).Error
+	is.NoErr(err)
+	is.Equal(byte(0), flags(raw(uncompressed.ID, "blob")))
+
+	records := make([]testCompressionRecord, 0)
+	err = db.Order("id").Find(&records).Error
+	is.NoErr(err)
+	is.Equal(2, len(records))
+	is.Equal(expected, records[0])
+	is.Equal(blob, records[1].Blob)
+
+	// the flags are authenticated along with the value
+	tampered := bytes.Replace(raw(record.ID, "blob"), []byte{database.FlagGzip}, []byte{database.FlagZstd}, 1)
+
+	err = db.Table("test_compression_records").Where("id = ?", record.ID).UpdateColumn("blob", tampered).Error
+	is.NoErr(err)
+
+	err = db.Select("id", "blob").First(&testCompressionRecord{}, record.ID).Error
+	is.True(err != nil)
+}
+
+func TestCompressionLimits(t *testing.T) {
+	is := is.New(t)
+
+	dsn := "file:compression_limits?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	blob := bytes.Repeat([]byte(`{"field":"a large, repetitive json blob"},`), 100)
+
+	_, err = encryption.Register(db,
+		encryption.WithKey(key),
+		encryption.WithMigration(),
+		encryption.WithCompression("gzip"),
+		encryption.WithCompressionThreshold(0),
+		encryption.WithMaxDecompressedSize(len(blob)),
+	)
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testCompressionRecord{})
+	is.NoErr(err)
+
+	// every value is compressed when the threshold is zero
+	small := bytes.Repeat([]byte("small"), 40)
+
+	record := testCompressionRecord{Blob: blob, Small: small, Zstd: blob, Snappy: blob, Record: blob}
+	err = db.Create(&record).Error
+	is.NoErr(err)
+
+	value := make([]byte, 0)
+	err = db.Table("test_compression_records").Select("small").Where("id = ?", record.ID).Row().Scan(&value)
+	is.NoErr(err)
+
+	_, flags, _, _ := database.ParseFlaggedField(value)
+	is.Equal(database.FlagGzip, flags)
+
+	decoded := testCompressionRecord{}
+	err = db.First(&decoded, record.ID).Error
+	is.NoErr(err)
+	is.Equal(blob, decoded.Blob)
+	is.Equal(blob, decoded.Zstd)
+	is.Equal(small, decoded.Small)
+
+	// values decompressing to more than the maximum size cannot be read
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMaxDecompressedSize(len(blob)-1))
+	is.NoErr(err)
+
+	for _, column := range []string{"small", "blob", "zstd", "snappy", "record"} {
+		err = db.Select("id", column).First(&testCompressionRecord{}, record.ID).Error
+		is.Equal(column != "small", err != nil)
+	}
+
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMaxDecompressedSize(-1))
+	is.NoErr(err)
+
+	err = db.First(&testCompressionRecord{}, record.ID).Error
+	is.NoErr(err)
+}
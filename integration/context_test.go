@@ -0,0 +1,149 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type traceKey struct{}
+
+type testContextRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+func TestContextPropagation(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:context?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db,
+		encryption.WithKey(key),
+		encryption.WithMigration(),
+		encryption.WithTenantResolver(tenantOf),
+	)
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testContextRecord{})
+	is.NoErr(err)
+
+	// key operations are made using the context of the statement
+	traces := make(map[string]bool)
+	mu := sync.Mutex{}
+
+	err = db.Callback().Query().Before("gorm:query").Register("test:trace_key_queries", func(db *gorm.DB) {
+		if trace, ok := db.Statement.Context.Value(traceKey{}).(string); ok && db.Statement.Table == "encryption_keys" {
+			mu.Lock()
+			traces[trace] = true
+			mu.Unlock()
+		}
+	})
+	is.NoErr(err)
+
+	record := &testContextRecord{Value: []byte("traced")}
+	err = db.WithContext(context.WithValue(withTenant(ctx, "a"), traceKey{}, "create")).Create(record).Error
+	is.NoErr(err)
+	is.True(traces["create"])
+
+	sch, err := schema.Parse(&testContextRecord{}, &sync.Map{}, schema.NamingStrategy{})
+	is.NoErr(err)
+
+	field := sch.LookUpField("value")
+
+	// cancelled contexts prevent keys from being created or loaded
+	cancelled, cancel := context.WithCancel(withTenant(ctx, "b"))
+	cancel()
+
+	_, err = field.Serializer.Value(cancelled, field, reflect.Value{}, []byte("cancelled"))
+	is.True(errors.Is(err, context.Canceled))
+
+	count := int64(0)
+	err = db.Model(&database.Key{}).Where("tenant = ?", "b").Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(0), count)
+
+	raw := make([][]byte, 0)
+	err = db.Table("test_context_records").Where("id = ?", record.ID).Pluck("value", &raw).Error
+	is.NoErr(err)
+
+	{
+		// a new connection is used so the key isn't already cached
+		db, err := gorm.Open(sqlite.Open(dsn))
+		is.NoErr(err)
+
+		_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithTenantResolver(tenantOf))
+		is.NoErr(err)
+
+		sch, err := schema.Parse(&testContextRecord{}, &sync.Map{}, schema.NamingStrategy{})
+		is.NoErr(err)
+
+		field := sch.LookUpField("value")
+
+		cancelled, cancel := context.WithCancel(withTenant(ctx, "a"))
+		cancel()
+
+		err = field.Serializer.Scan(cancelled, field, reflect.ValueOf(&testContextRecord{}), raw[0])
+		is.True(errors.Is(err, context.Canceled))
+
+		decoded := &testContextRecord{}
+		err = db.WithContext(withTenant(ctx, "a")).First(decoded, record.ID).Error
+		is.NoErr(err)
+		is.Equal("traced", string(decoded.Value))
+	}
+
+	// keys are committed independently of the transaction that needed them. when the transaction is rolled back, the
+	// key remains and is used by later writes
+	tenantCtx := withTenant(ctx, "c")
+
+	err = db.WithContext(tenantCtx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&testContextRecord{Value: []byte("rolled back")}).Error
+		if err != nil {
+			return err
+		}
+
+		return errors.New("rollback")
+	})
+	is.Equal("rollback", err.Error())
+
+	keys := make([]database.Key, 0)
+	err = db.Where("tenant = ?", "c").Find(&keys).Error
+	is.NoErr(err)
+	is.Equal(1, len(keys))
+
+	record = &testContextRecord{Value: []byte("committed")}
+	err = db.WithContext(tenantCtx).Create(record).Error
+	is.NoErr(err)
+
+	raw = raw[:0]
+	err = db.Table("test_context_records").Where("id = ?", record.ID).Pluck("value", &raw).Error
+	is.NoErr(err)
+
+	_, fingerprint, _ := database.ParseField(raw[0])
+	is.Equal(keys[0].Fingerprint, fingerprint)
+
+	decoded := &testContextRecord{}
+	err = db.WithContext(tenantCtx).First(decoded, record.ID).Error
+	is.NoErr(err)
+	is.Equal("committed", string(decoded.Value))
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testCoordinationRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+func TestCoordinatedRotation(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:coordination?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testCoordinationRecord{})
+	is.NoErr(err)
+
+	// replicas starting up converge on the same key
+	for idx := 0; idx < 3; idx++ {
+		replica, err := gorm.Open(sqlite.Open(dsn))
+		is.NoErr(err)
+
+		_, err = encryption.Register(replica, encryption.WithKey(key))
+		is.NoErr(err)
+	}
+
+	old := database.Key{}
+	err = db.First(&old).Error
+	is.NoErr(err)
+
+	var count int64
+	err = db.Model(&database.Key{}).Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(1), count)
+
+	// expire the key
+	err = db.Model(&old).UpdateColumn("created_at", time.Now().Add(-1*time.Hour)).Error
+	is.NoErr(err)
+
+	// simulate another replica rotating the key while this replica is also attempting to rotate it
+	competing := &database.Key{Fingerprint: "competing", Status: database.KeyActive}
+
+	replica, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	race := true
+	// the competing rotation is committed right after this replica checks for existing rotations
+	err = replica.Callback().Query().After("gorm:query").Register("test:race", func(db *gorm.DB) {
+		if _, ok := db.Statement.Model.(*database.KeyRotation); !ok || !race {
+			return
+		}
+
+		race = false
+
+		dataKey, err := encryption.GenerateKey()
+		is.NoErr(err)
+
+		competing.DataKey, err = encryption.LocalKeyProvider(key).Wrap(ctx, dataKey)
+		is.NoErr(err)
+
+		txn := db.Session(&gorm.Session{NewDB: true})
+		is.NoErr(txn.Create(competing).Error)
+		is.NoErr(txn.Create(&database.KeyRotation{Previous: old.Fingerprint, Fingerprint: competing.Fingerprint}).Error)
+	})
+	is.NoErr(err)
+
+	_, err = encryption.Register(replica, encryption.WithKey(key), encryption.WithRotationDuration(time.Minute))
+	is.NoErr(err)
+	is.True(!race)
+
+	err = replica.Create(&testCoordinationRecord{Value: []byte("value")}).Error
+	is.NoErr(err)
+
+	raw := make([]byte, 0)
+	err = replica.Table("test_coordination_records").Select("value").Row().Scan(&raw)
+	is.NoErr(err)
+
+	_, fingerprint, _ := database.ParseField(raw)
+	is.Equal(competing.Fingerprint, fingerprint)
+
+	// the key minted by the replica that lost the race is discarded
+	err = db.Model(&database.Key{}).Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(2), count)
+}
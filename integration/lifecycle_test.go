@@ -0,0 +1,119 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testLifecycleRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+func TestKeyLifecycle(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:lifecycle?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db,
+		encryption.WithKey(key),
+		encryption.WithMigration(),
+		encryption.WithCacheDuration(time.Millisecond),
+	)
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testLifecycleRecord{})
+	is.NoErr(err)
+
+	first := &testLifecycleRecord{Value: []byte("first")}
+	err = db.Create(first).Error
+	is.NoErr(err)
+
+	old := database.Key{}
+	err = db.First(&old).Error
+	is.NoErr(err)
+	is.Equal(database.KeyActive, old.Status)
+
+	read := func(id int) ([]byte, error) {
+		record := &testLifecycleRecord{}
+		err := db.First(record, id).Error
+		return record.Value, err
+	}
+
+	// keys must move through the lifecycle in order
+	err = encryption.TransitionKey(ctx, db, old.Fingerprint, database.KeyDestroyed)
+	is.True(errors.Is(err, encryption.ErrInvalidTransition))
+
+	// decrypt-only keys continue to decrypt, but are no longer used for new values
+	err = encryption.TransitionKey(ctx, db, old.Fingerprint, database.KeyDecryptOnly)
+	is.NoErr(err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	second := &testLifecycleRecord{Value: []byte("second")}
+	err = db.Create(second).Error
+	is.NoErr(err)
+
+	remaining, err := encryption.CountRemaining(ctx, db, testLifecycleRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(map[string]int64{old.Fingerprint: 1}, remaining)
+
+	value, err := read(first.ID)
+	is.NoErr(err)
+	is.Equal("first", string(value))
+
+	// soft-deleted keys continue to decrypt
+	err = db.Delete(&old).Error
+	is.NoErr(err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	value, err = read(first.ID)
+	is.NoErr(err)
+	is.Equal("first", string(value))
+
+	// retired keys fail to decrypt
+	err = encryption.TransitionKey(ctx, db, old.Fingerprint, database.KeyRetired)
+	is.NoErr(err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = read(first.ID)
+	is.True(errors.Is(err, encryption.ErrKeyRetired))
+
+	value, err = read(second.ID)
+	is.NoErr(err)
+	is.Equal("second", string(value))
+
+	// destroyed keys are erased
+	err = encryption.TransitionKey(ctx, db, old.Fingerprint, database.KeyDestroyed)
+	is.NoErr(err)
+
+	destroyed := database.Key{}
+	err = db.Unscoped().First(&destroyed, "fingerprint = ?", old.Fingerprint).Error
+	is.NoErr(err)
+	is.Equal(0, len(destroyed.DataKey))
+
+	_, err = read(first.ID)
+	is.True(errors.Is(err, encryption.ErrKeyDestroyed))
+
+	err = encryption.TransitionKey(ctx, db, old.Fingerprint, database.KeyRetired)
+	is.True(errors.Is(err, encryption.ErrInvalidTransition))
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testLookupRecord struct {
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+func TestKeyLookups(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:lookups?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	parse := func() *schema.Field {
+		sch, err := schema.Parse(&testLookupRecord{}, &sync.Map{}, schema.NamingStrategy{})
+		is.NoErr(err)
+
+		return sch.LookUpField("value")
+	}
+
+	field := parse()
+
+	value, err := field.Serializer.Value(ctx, field, reflect.Value{}, []byte("hello"))
+	is.NoErr(err)
+
+	algorithm, _, ciphertext := database.ParseField(value.([]byte))
+	unknown := database.FormatField(algorithm, "unknown", ciphertext)
+
+	// register with an empty cache, slowing down key lookups so concurrent reads overlap
+	register := func(opts ...encryption.Option) (*schema.Field, *int64) {
+		db, err := gorm.Open(sqlite.Open(dsn))
+		is.NoErr(err)
+
+		_, err = encryption.Register(db, append(opts, encryption.WithKey(key))...)
+		is.NoErr(err)
+
+		queries := new(int64)
+
+		err = db.Callback().Query().Before("gorm:query").Register("test:slow_key_queries", func(db *gorm.DB) {
+			if db.Statement.Table == "encryption_keys" {
+				atomic.AddInt64(queries, 1)
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+		is.NoErr(err)
+
+		return parse(), queries
+	}
+
+	scanConcurrently := func(field *schema.Field, value []byte) []error {
+		errs := make([]error, 10)
+		wg := sync.WaitGroup{}
+
+		for idx := range errs {
+			wg.Add(1)
+
+			go func(idx int) {
+				defer wg.Done()
+
+				record := &testLookupRecord{}
+				errs[idx] = field.Serializer.Scan(ctx, field, reflect.ValueOf(record), value)
+
+				if errs[idx] == nil && string(record.Value) != "hello" {
+					errs[idx] = errors.New("unexpected plaintext: " + string(record.Value))
+				}
+			}(idx)
+		}
+
+		wg.Wait()
+
+		return errs
+	}
+
+	{
+		// concurrent lookups of the same key share a single query
+		field, queries := register()
+
+		for _, err := range scanConcurrently(field, value.([]byte)) {
+			is.NoErr(err)
+		}
+
+		is.Equal(int64(1), atomic.LoadInt64(queries))
+
+		// keys that cannot be found are remembered
+		for idx := 0; idx < 3; idx++ {
+			err = field.Serializer.Scan(ctx, field, reflect.ValueOf(&testLookupRecord{}), unknown)
+			is.True(errors.Is(err, gorm.ErrRecordNotFound))
+		}
+
+		is.Equal(int64(2), atomic.LoadInt64(queries))
+	}
+
+	{
+		// both behaviors can be disabled
+		field, queries := register(encryption.WithoutLookupCoalescing(), encryption.WithNegativeCacheDuration(-1))
+
+		for _, err := range scanConcurrently(field, value.([]byte)) {
+			is.NoErr(err)
+		}
+
+		is.True(atomic.LoadInt64(queries) > 1)
+
+		atomic.StoreInt64(queries, 0)
+
+		for idx := 0; idx < 3; idx++ {
+			err = field.Serializer.Scan(ctx, field, reflect.ValueOf(&testLookupRecord{}), unknown)
+			is.True(errors.Is(err, gorm.ErrRecordNotFound))
+		}
+
+		is.Equal(int64(3), atomic.LoadInt64(queries))
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testManagerRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+type testManagerLookupRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Email []byte `gorm:"type:bytes;serializer:aes"`
+}
+
+func TestManager(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:manager?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	manager, err := encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testManagerRecord{}, testManagerLookupRecord{})
+	is.NoErr(err)
+
+	lookup := &testManagerLookupRecord{Email: []byte("user@example.com")}
+	err = db.Create(lookup).Error
+	is.NoErr(err)
+
+	first := &testManagerRecord{Value: []byte("first")}
+	err = db.Create(first).Error
+	is.NoErr(err)
+
+	for idx := 0; idx < 2; idx++ {
+		err = db.First(&testManagerRecord{}, first.ID).Error
+		is.NoErr(err)
+	}
+
+	stats := manager.Stats()
+	is.Equal(int64(1), stats.ActiveKeys)
+	is.Equal(int64(1), stats.CachedKeys)
+	is.Equal(int64(1), stats.CacheMisses)
+	is.Equal(int64(1), stats.CacheHits)
+	is.Equal(int64(2), stats.Decrypted)
+	is.True(stats.Encrypted >= 1)
+
+	// values encrypted using the root key directly are counted as well
+	err = db.Create(&testManagerLookupRecord{Email: []byte("other@example.com")}).Error
+	is.NoErr(err)
+
+	err = db.First(&testManagerLookupRecord{}, lookup.ID).Error
+	is.NoErr(err)
+
+	is.Equal(stats.Encrypted+1, manager.Stats().Encrypted)
+	is.Equal(stats.Decrypted+1, manager.Stats().Decrypted)
+
+	// forcing a rotation immediately moves new values to a new key
+	old := database.Key{}
+	err = db.First(&old).Error
+	is.NoErr(err)
+
+	err = manager.ForceRotate(ctx)
+	is.NoErr(err)
+
+	var count int64
+	err = db.Model(&database.Key{}).Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(2), count)
+
+	err = db.Create(&testManagerRecord{Value: []byte("second")}).Error
+	is.NoErr(err)
+
+	remaining, err := encryption.CountRemaining(ctx, db, testManagerRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(map[string]int64{old.Fingerprint: 1}, remaining)
+
+	// closed managers discard their keys and can no longer be used
+	err = manager.Close()
+	is.NoErr(err)
+
+	stats = manager.Stats()
+	is.Equal(int64(0), stats.ActiveKeys)
+	is.Equal(int64(0), stats.CachedKeys)
+
+	err = db.Create(&testManagerRecord{Value: []byte("third")}).Error
+	is.True(errors.Is(err, encryption.ErrClosed))
+
+	err = db.First(&testManagerRecord{}, first.ID).Error
+	is.True(errors.Is(err, encryption.ErrClosed))
+
+	err = db.First(&testManagerLookupRecord{}, lookup.ID).Error
+	is.True(errors.Is(err, encryption.ErrClosed))
+}
+
+func TestManagerCloseWhileRefreshing(t *testing.T) {
+	is := is.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:manager_close?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	// keys are refreshed in the background on nearly every write
+	manager, err := encryption.Register(db,
+		encryption.WithKey(key),
+		encryption.WithMigration(),
+		encryption.WithCacheDuration(time.Millisecond),
+	)
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testManagerRecord{})
+	is.NoErr(err)
+
+	// closing the manager removes its callbacks from db, which gorm doesn't allow while the database is in use
+	writer, err := gorm.Open(sqlite.Open("file:manager_close?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	wg := sync.WaitGroup{}
+	for idx := 0; idx < 4; idx++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				err := writer.Create(&testManagerRecord{Value: []byte("value")}).Error
+				if errors.Is(err, encryption.ErrClosed) {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	err = manager.Close()
+	is.NoErr(err)
+
+	wg.Wait()
+
+	is.Equal(int64(0), manager.Stats().ActiveKeys)
+}
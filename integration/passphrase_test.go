@@ -0,0 +1,137 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testPassphraseRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+type testPassphraseRootKeyRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes"`
+}
+
+func TestPassphrase(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:passphrase?mode=memory&cache=shared"
+
+	// keep the tests fast
+	weak := encryption.KDFParams{Time: 1, Memory: 1024, Threads: 1}
+	strong := encryption.KDFParams{Time: 2, Memory: 2048, Threads: 1}
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db,
+		encryption.WithPassphrase("correct horse"),
+		encryption.WithKDFParams(weak),
+		encryption.WithMigration(),
+	)
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testPassphraseRecord{}, testPassphraseRootKeyRecord{})
+	is.NoErr(err)
+
+	err = db.Create(&testPassphraseRecord{Value: []byte("secret")}).Error
+	is.NoErr(err)
+
+	metadata := database.Metadata{}
+	err = db.First(&metadata).Error
+	is.NoErr(err)
+	is.Equal("root_key_kdf", metadata.Name)
+
+	// the stored parameters are followed by a verifier for the passphrase
+	is.Equal(6, len(strings.Split(metadata.Value, "$")))
+
+	// other processes are unable to start using the wrong passphrase
+	_, err = encryption.Register(db, encryption.WithPassphrase("battery staple"))
+	is.True(errors.Is(err, encryption.ErrIncorrectPassphrase))
+
+	// other processes derive the same key using the stored parameters, even when configured differently
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithPassphrase("correct horse"), encryption.WithKDFParams(strong))
+	is.NoErr(err)
+
+	decoded := &testPassphraseRecord{}
+	err = db.First(decoded).Error
+	is.NoErr(err)
+	is.Equal("secret", string(decoded.Value))
+
+	_, err = encryption.Register(db, encryption.WithPassphrase("correct horse"), encryption.WithKey(make([]byte, 32)))
+	is.True(err != nil)
+
+	upgrade, err := encryption.NeedsPassphraseUpgrade(ctx, db, weak)
+	is.NoErr(err)
+	is.True(!upgrade)
+
+	upgrade, err = encryption.NeedsPassphraseUpgrade(ctx, db, strong)
+	is.NoErr(err)
+	is.True(upgrade)
+
+	models := encryption.WithModels(testPassphraseRecord{}, testPassphraseRootKeyRecord{})
+
+	// the old passphrase must be correct for the upgrade to proceed
+	err = encryption.UpgradePassphrase(ctx, db, "battery staple", "battery staple", strong, models)
+	is.True(errors.Is(err, encryption.ErrIncorrectPassphrase))
+
+	// every model must be provided to check for values encrypted using the root key directly
+	err = encryption.UpgradePassphrase(ctx, db, "correct horse", "battery staple", strong)
+	is.True(errors.Is(err, encryption.ErrNoModels))
+
+	err = db.Create(&testPassphraseRootKeyRecord{Value: []byte("secret")}).Error
+	is.NoErr(err)
+
+	referenced := &encryption.KeyReferencedError{}
+
+	err = encryption.UpgradePassphrase(ctx, db, "correct horse", "battery staple", strong, models)
+	is.True(errors.As(err, &referenced))
+	is.Equal(int64(1), referenced.Tables["test_passphrase_root_key_records"])
+
+	err = db.Where("1 = 1").Delete(&testPassphraseRootKeyRecord{}).Error
+	is.NoErr(err)
+
+	err = encryption.UpgradePassphrase(ctx, db, "correct horse", "battery staple", strong, models)
+	is.NoErr(err)
+
+	upgrade, err = encryption.NeedsPassphraseUpgrade(ctx, db, strong)
+	is.NoErr(err)
+	is.True(!upgrade)
+
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithPassphrase("battery staple"))
+	is.NoErr(err)
+
+	decoded = &testPassphraseRecord{}
+	err = db.First(decoded).Error
+	is.NoErr(err)
+	is.Equal("secret", string(decoded.Value))
+
+	// the wrong passphrase derives a different root key, which is unable to unwrap the current data key
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithPassphrase("correct horse"))
+	is.True(errors.Is(err, encryption.ErrIncorrectPassphrase))
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+
+	"go.pitz.tech/gorm/encryption"
+)
+
+type testPrefetchRecord struct {
+	ID        int    `gorm:"primaryKey;autoIncrement"`
+	Name      string `gorm:"size:32"`
+	CreatedAt time.Time
+	Value     []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Other     []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+// countKeyQueries counts the number of queries issued against the encryption_keys table.
+func countKeyQueries(db *gorm.DB) *int {
+	count := new(int)
+
+	_ = db.Callback().Query().After("gorm:query").Register("test:count_key_queries", func(db *gorm.DB) {
+		if db.Statement.Table == "encryption_keys" {
+			*count++
+		}
+	})
+
+	return count
+}
+
+func TestPrefetch(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:prefetch?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	manager, err := encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testPrefetchRecord{})
+	is.NoErr(err)
+
+	// spread the records across several data keys
+	for idx := 0; idx < 12; idx++ {
+		err = manager.ForceRotate(ctx)
+		is.NoErr(err)
+
+		other := []byte(fmt.Sprintf("other-%d", idx))
+		if idx%3 == 0 {
+			other = nil
+		}
+
+		err = db.Create(&testPrefetchRecord{
+			Name:  fmt.Sprintf("record-%d", idx),
+			Value: []byte(fmt.Sprintf("value-%d", idx)),
+			Other: other,
+		}).Error
+		is.NoErr(err)
+	}
+
+	verify := func(records []testPrefetchRecord) {
+		is.Equal(12, len(records))
+
+		for idx, record := range records {
+			is.Equal(fmt.Sprintf("record-%d", idx), record.Name)
+			is.True(!record.CreatedAt.IsZero())
+			is.Equal(fmt.Sprintf("value-%d", idx), string(record.Value))
+
+			if idx%3 == 0 {
+				is.Equal(0, len(record.Other))
+			} else {
+				is.Equal(fmt.Sprintf("other-%d", idx), string(record.Other))
+			}
+		}
+	}
+
+	// without prefetching, every data key is loaded using its own query
+	{
+		db, err := gorm.Open(sqlite.Open(dsn))
+		is.NoErr(err)
+
+		_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithCacheSize(2))
+		is.NoErr(err)
+
+		queries := countKeyQueries(db)
+
+		records := make([]testPrefetchRecord, 0)
+		err = db.Order("id").Find(&records).Error
+		is.NoErr(err)
+		verify(records)
+		is.True(*queries >= 12)
+	}
+
+	// with prefetching, all missing data keys are loaded using a single query
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	manager, err = encryption.Register(db, encryption.WithKey(key), encryption.WithCacheSize(2), encryption.WithKeyPrefetch())
+	is.NoErr(err)
+
+	queries := countKeyQueries(db)
+
+	records := make([]testPrefetchRecord, 0)
+	err = db.Order("id").Find(&records).Error
+	is.NoErr(err)
+	verify(records)
+	is.Equal(1, *queries)
+	is.Equal(int64(12), manager.Stats().CacheMisses)
+
+	// keys still in the cache aren't loaded again
+	*queries = 0
+
+	record := testPrefetchRecord{}
+	err = db.Order("id desc").First(&record).Error
+	is.NoErr(err)
+	is.Equal("value-11", string(record.Value))
+	is.Equal(0, *queries)
+
+	// queries that don't return encrypted columns are left alone
+	names := make([]string, 0)
+	err = db.Model(testPrefetchRecord{}).Order("id").Pluck("name", &names).Error
+	is.NoErr(err)
+	is.Equal(12, len(names))
+
+	rows := make([]map[string]any, 0)
+	err = db.Model(testPrefetchRecord{}).Order("id").Find(&rows).Error
+	is.NoErr(err)
+	is.Equal(12, len(rows))
+	is.Equal(0, *queries)
+
+	// large results are buffered in batches, loading the missing keys of each batch using a single query
+	for _, count := range []int{1000, 500} {
+		err = manager.ForceRotate(ctx)
+		is.NoErr(err)
+
+		batch := make([]testPrefetchRecord, 0, count)
+		for idx := 0; idx < count; idx++ {
+			batch = append(batch, testPrefetchRecord{Name: "batch", Value: []byte(fmt.Sprint(count))})
+		}
+
+		err = db.CreateInBatches(batch, 100).Error
+		is.NoErr(err)
+	}
+
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithKeyPrefetch())
+	is.NoErr(err)
+
+	queries = countKeyQueries(db)
+
+	records = make([]testPrefetchRecord, 0)
+	err = db.Where("name = ?", "batch").Order("id").Find(&records).Error
+	is.NoErr(err)
+	is.Equal(1500, len(records))
+	is.Equal("1000", string(records[999].Value))
+	is.Equal("500", string(records[1000].Value))
+	is.Equal(2, *queries)
+
+	// prefetching refuses to replace a query callback registered by another plugin
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	err = db.Callback().Query().Replace("gorm:query", func(db *gorm.DB) { callbacks.Query(db) })
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithKeyPrefetch())
+	is.True(err != nil)
+
+	// closing the manager leaves query callbacks registered by other plugins in place
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	manager, err = encryption.Register(db, encryption.WithKey(key), encryption.WithKeyPrefetch())
+	is.NoErr(err)
+
+	replaced := false
+	err = db.Callback().Query().Replace("gorm:query", func(db *gorm.DB) {
+		replaced = true
+		callbacks.Query(db)
+	})
+	is.NoErr(err)
+
+	err = manager.Close()
+	is.NoErr(err)
+
+	_ = db.First(&testPrefetchRecord{}).Error
+	is.True(replaced)
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testRecordKeyRecord struct {
+	ID    int `gorm:"primaryKey;autoIncrement"`
+	Name  string
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm-record"`
+	Other []byte `gorm:"type:bytes;serializer:aes-gcm-record"`
+}
+
+func TestRecordKeys(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:record_keys?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testRecordKeyRecord{})
+	is.NoErr(err)
+
+	records := make([]*testRecordKeyRecord, 0)
+	for idx := 0; idx < 3; idx++ {
+		records = append(records, &testRecordKeyRecord{
+			Value: []byte(fmt.Sprintf("value-%d", idx)),
+			Other: []byte(fmt.Sprintf("other-%d", idx)),
+		})
+	}
+
+	err = db.Create(records).Error
+	is.NoErr(err)
+
+	// each record is given a single key, shared by all of its fields
+	keys := make([]database.RecordKey, 0)
+	err = db.Order("record_id").Find(&keys).Error
+	is.NoErr(err)
+	is.Equal(3, len(keys))
+
+	for idx, key := range keys {
+		is.Equal("test_record_key_records", key.Table)
+		is.Equal(fmt.Sprint(records[idx].ID), key.RecordID)
+	}
+
+	// updates reuse the key belonging to the record
+	records[0].Value = []byte("updated")
+	err = db.Save(records[0]).Error
+	is.NoErr(err)
+
+	var count int64
+	err = db.Model(&database.RecordKey{}).Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(3), count)
+
+	// updates must identify the record being written
+	err = db.Model(&testRecordKeyRecord{}).Where("id = ?", records[1].ID).Updates(&testRecordKeyRecord{Value: []byte("x")}).Error
+	is.True(err != nil)
+
+	// keys created within a transaction are rolled back along with the record
+	err = db.Transaction(func(txn *gorm.DB) error {
+		err := txn.Create(&testRecordKeyRecord{Value: []byte("rollback")}).Error
+		is.NoErr(err)
+
+		return errors.New("rollback")
+	})
+	is.True(err != nil)
+
+	err = db.Model(&database.RecordKey{}).Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(3), count)
+
+	// shredding a record only affects that record
+	err = encryption.ShredRecord(ctx, db, records[1])
+	is.NoErr(err)
+
+	err = encryption.ShredRecord(ctx, db, &testRecordKeyRecord{})
+	is.True(err != nil)
+
+	decoded := &testRecordKeyRecord{}
+	err = db.First(decoded, records[1].ID).Error
+	is.True(errors.Is(err, encryption.ErrKeyDestroyed))
+
+	// updates that don't write encrypted fields don't create keys
+	err = db.Model(records[1]).Update("name", "shredded").Error
+	is.NoErr(err)
+
+	err = db.Model(records[1]).Updates(&testRecordKeyRecord{Name: "shredded"}).Error
+	is.NoErr(err)
+
+	err = db.Model(&database.RecordKey{}).Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(2), count)
+
+	decoded = &testRecordKeyRecord{}
+	err = db.First(decoded, records[0].ID).Error
+	is.NoErr(err)
+	is.Equal("updated", string(decoded.Value))
+	is.Equal("other-0", string(decoded.Other))
+
+	decoded = &testRecordKeyRecord{}
+	err = db.First(decoded, records[2].ID).Error
+	is.NoErr(err)
+	is.Equal("value-2", string(decoded.Value))
+	is.Equal("other-2", string(decoded.Other))
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testReencryptRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Other []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+func TestReencrypt(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:reencrypt?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testReencryptRecord{})
+	is.NoErr(err)
+
+	for idx := 0; idx < 5; idx++ {
+		err = db.Create(&testReencryptRecord{
+			Value: []byte(fmt.Sprintf("value-%d", idx)),
+			Other: []byte(fmt.Sprintf("other-%d", idx)),
+		}).Error
+		is.NoErr(err)
+	}
+
+	old := database.Key{}
+	err = db.First(&old).Error
+	is.NoErr(err)
+
+	// introduce a newer data key and pick it up using a new connection
+
+	dataKey, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	wrapped, err := encryption.LocalKeyProvider(key).Wrap(ctx, dataKey)
+	is.NoErr(err)
+
+	err = db.Create(&database.Key{
+		Fingerprint: "current",
+		CreatedAt:   time.Now().Add(time.Minute),
+		DataKey:     wrapped,
+	}).Error
+	is.NoErr(err)
+
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key))
+	is.NoErr(err)
+
+	remaining, err := encryption.CountRemaining(ctx, db, testReencryptRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(map[string]int64{old.Fingerprint: 5}, remaining)
+
+	// only re-encrypt the first few rows, resuming from the reported cursor
+	progress := make([]encryption.Progress, 0)
+	err = encryption.Reencrypt(ctx, db, testReencryptRecord{}, nil,
+		encryption.WithBatchSize(2),
+		encryption.WithRateLimit(1000),
+		encryption.WithProgress(func(p encryption.Progress) { progress = append(progress, p) }),
+	)
+	is.NoErr(err)
+	is.Equal(3, len(progress))
+	is.Equal(int64(5), progress[2].Processed)
+	is.Equal(int64(5), progress[2].Updated)
+
+	remaining, err = encryption.CountRemaining(ctx, db, testReencryptRecord{}, []string{"value"})
+	is.NoErr(err)
+	is.Equal(0, len(remaining))
+
+	progress = progress[:0]
+	err = encryption.Reencrypt(ctx, db, testReencryptRecord{}, []string{"value", "other"},
+		encryption.WithCursor(2),
+		encryption.WithProgress(func(p encryption.Progress) { progress = append(progress, p) }),
+	)
+	is.NoErr(err)
+	is.Equal(1, len(progress))
+	is.Equal(int64(3), progress[0].Processed)
+	is.Equal(int64(0), progress[0].Updated)
+
+	records := make([]testReencryptRecord, 0)
+	err = db.Order("id").Find(&records).Error
+	is.NoErr(err)
+	is.Equal(5, len(records))
+
+	for idx, record := range records {
+		is.Equal(fmt.Sprintf("value-%d", idx), string(record.Value))
+		is.Equal(fmt.Sprintf("other-%d", idx), string(record.Other))
+	}
+
+	_, err = encryption.CountRemaining(ctx, db, testReencryptRecord{}, []string{"id"})
+	is.True(err != nil)
+}
+
+func TestReencryptConcurrentWrite(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:reencrypt-concurrent?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	manager, err := encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testReencryptRecord{})
+	is.NoErr(err)
+
+	for idx := 0; idx < 3; idx++ {
+		err = db.Create(&testReencryptRecord{
+			Value: []byte(fmt.Sprintf("value-%d", idx)),
+			Other: []byte(fmt.Sprintf("other-%d", idx)),
+		}).Error
+		is.NoErr(err)
+	}
+
+	err = manager.ForceRotate(ctx)
+	is.NoErr(err)
+
+	// write to the first row after the job has read it, but before it's written back
+	armed := true
+	err = db.Callback().Query().After("gorm:query").Register("test:concurrent_write", func(tx *gorm.DB) {
+		if !armed || tx.Statement.Schema == nil || tx.Statement.Schema.Name != "testReencryptRecord" {
+			return
+		}
+
+		armed = false
+
+		row := &testReencryptRecord{ID: 1, Value: []byte("concurrent")}
+		_ = tx.AddError(tx.Session(&gorm.Session{NewDB: true}).Model(row).Select("value").UpdateColumns(row).Error)
+	})
+	is.NoErr(err)
+
+	progress := encryption.Progress{}
+	err = encryption.Reencrypt(ctx, db, testReencryptRecord{}, nil,
+		encryption.WithProgress(func(p encryption.Progress) { progress = p }),
+	)
+	is.NoErr(err)
+	is.True(!armed)
+	is.Equal(int64(3), progress.Processed)
+	is.Equal(int64(2), progress.Updated)
+
+	err = db.Callback().Query().Remove("test:concurrent_write")
+	is.NoErr(err)
+
+	// the application's write is kept rather than being overwritten by the job
+	record := testReencryptRecord{}
+	err = db.First(&record, 1).Error
+	is.NoErr(err)
+	is.Equal("concurrent", string(record.Value))
+	is.Equal("other-0", string(record.Other))
+
+	// skipped rows are picked up the next time the job runs
+	remaining, err := encryption.CountRemaining(ctx, db, testReencryptRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(1, len(remaining))
+
+	err = encryption.Reencrypt(ctx, db, testReencryptRecord{}, nil)
+	is.NoErr(err)
+
+	remaining, err = encryption.CountRemaining(ctx, db, testReencryptRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(0, len(remaining))
+
+	record = testReencryptRecord{}
+	err = db.First(&record, 1).Error
+	is.NoErr(err)
+	is.Equal("concurrent", string(record.Value))
+}
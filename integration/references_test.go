@@ -0,0 +1,155 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testReferencesRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Plain []byte
+}
+
+func TestDeleteKey(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:references?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testReferencesRecord{}, testReencryptRecord{})
+	is.NoErr(err)
+
+	err = db.Create(&testReferencesRecord{Value: []byte("value"), Plain: []byte("plain")}).Error
+	is.NoErr(err)
+
+	for idx := 0; idx < 2; idx++ {
+		err = db.Create(&testReencryptRecord{Value: []byte("value"), Other: []byte("other")}).Error
+		is.NoErr(err)
+	}
+
+	current := database.Key{}
+	err = db.First(&current).Error
+	is.NoErr(err)
+
+	err = db.Create(&database.Key{Fingerprint: "unused", DataKey: []byte{}, Status: database.KeyRetired}).Error
+	is.NoErr(err)
+
+	references, err := encryption.FindReferences(ctx, db, testReferencesRecord{}, testReencryptRecord{})
+	is.NoErr(err)
+	is.Equal(encryption.References{
+		current.Fingerprint: {
+			"test_references_records": 1,
+			"test_reencrypt_records":  2,
+		},
+	}, references)
+	is.Equal(int64(3), references.Count(current.Fingerprint))
+
+	// keys that are still in use are not deleted, even once nothing references them
+	err = encryption.DeleteKey(ctx, db, current.Fingerprint, false, testReferencesRecord{}, testReencryptRecord{})
+	is.True(errors.Is(err, encryption.ErrKeyNotRetired))
+
+	err = db.Create(&database.Key{Fingerprint: "active", DataKey: []byte{}, Status: database.KeyActive}).Error
+	is.NoErr(err)
+
+	err = encryption.DeleteKey(ctx, db, "active", false, testReferencesRecord{}, testReencryptRecord{})
+	is.True(errors.Is(err, encryption.ErrKeyNotRetired))
+
+	err = db.Unscoped().Delete(&database.Key{Fingerprint: "active"}).Error
+	is.NoErr(err)
+
+	// referenced keys are not deleted
+	err = db.Model(&current).Update("status", database.KeyRetired).Error
+	is.NoErr(err)
+
+	err = encryption.DeleteKey(ctx, db, current.Fingerprint, false, testReferencesRecord{}, testReencryptRecord{})
+
+	referenced := &encryption.KeyReferencedError{}
+	is.True(errors.As(err, &referenced))
+	is.Equal(map[string]int64{"test_references_records": 1, "test_reencrypt_records": 2}, referenced.Tables)
+
+	// unreferenced keys are deleted
+	err = encryption.DeleteKey(ctx, db, "unused", false, testReferencesRecord{}, testReencryptRecord{})
+	is.NoErr(err)
+
+	err = encryption.DeleteKey(ctx, db, "unused", false, testReferencesRecord{}, testReencryptRecord{})
+	is.True(errors.Is(err, gorm.ErrRecordNotFound))
+
+	// keys cannot be checked for references without any models to scan
+	_, err = encryption.FindReferences(ctx, db)
+	is.True(errors.Is(err, encryption.ErrNoModels))
+
+	err = encryption.DeleteKey(ctx, db, current.Fingerprint, false)
+	is.True(errors.Is(err, encryption.ErrNoModels))
+
+	// referenced keys can be deleted when forced
+	err = encryption.DeleteKey(ctx, db, current.Fingerprint, true)
+	is.NoErr(err)
+
+	count := int64(0)
+	err = db.Unscoped().Model(&database.Key{}).Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(0), count)
+}
+
+func TestDeleteActiveKey(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:delete_active_key?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testReferencesRecord{})
+	is.NoErr(err)
+
+	// the active key cannot be deleted, even once nothing references it
+	err = db.Create(&testReferencesRecord{Value: []byte("value")}).Error
+	is.NoErr(err)
+
+	err = db.Delete(&testReferencesRecord{}, "1 = 1").Error
+	is.NoErr(err)
+
+	active := database.Key{}
+	err = db.First(&active).Error
+	is.NoErr(err)
+
+	err = encryption.DeleteKey(ctx, db, active.Fingerprint, false, testReferencesRecord{})
+	is.True(errors.Is(err, encryption.ErrKeyNotRetired))
+
+	// forcing the deletion drops the key from memory, so new values are encrypted using a new key
+	err = encryption.DeleteKey(ctx, db, active.Fingerprint, true)
+	is.NoErr(err)
+
+	record := &testReferencesRecord{Value: []byte("value")}
+	err = db.Create(record).Error
+	is.NoErr(err)
+
+	decoded := &testReferencesRecord{}
+	err = db.First(decoded, record.ID).Error
+	is.NoErr(err)
+	is.Equal("value", string(decoded.Value))
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+func TestRotateRootKey(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:rotation?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	oldKey, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	newKey, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	oldProvider := encryption.LocalKeyProvider(oldKey)
+	newProvider := encryption.LocalKeyProvider(newKey)
+
+	_, err = encryption.Register(db,
+		encryption.WithKey(oldKey),
+		encryption.WithMigration(),
+		encryption.WithMarshaling(json.Marshal, json.Unmarshal),
+	)
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testAESGCMRecord{})
+	is.NoErr(err)
+
+	expected := TypesAESGCM{Bytes: []byte("rotate me")}
+
+	err = db.Create(&testAESGCMRecord{TypesAESGCM: expected}).Error
+	is.NoErr(err)
+
+	// add a few more data keys so the rotation spans multiple batches
+	for idx := 0; idx < 4; idx++ {
+		dataKey, err := encryption.GenerateKey()
+		is.NoErr(err)
+
+		wrapped, err := oldProvider.Wrap(ctx, dataKey)
+		is.NoErr(err)
+
+		err = db.Create(&database.Key{Fingerprint: string(rune('a' + idx)), DataKey: wrapped}).Error
+		is.NoErr(err)
+	}
+
+	{
+		// keys that cannot be unwrapped prevent the rotation from committing anything
+		unknownKey, err := encryption.GenerateKey()
+		is.NoErr(err)
+
+		wrapped, err := encryption.LocalKeyProvider(unknownKey).Wrap(ctx, unknownKey)
+		is.NoErr(err)
+
+		err = db.Create(&database.Key{Fingerprint: "z", DataKey: wrapped}).Error
+		is.NoErr(err)
+
+		err = encryption.RotateRootKey(ctx, db, oldProvider, newProvider, encryption.WithBatchSize(2))
+		is.True(err != nil)
+
+		keys := make([]database.Key, 0)
+		err = db.Where("fingerprint <> ?", "z").Find(&keys).Error
+		is.NoErr(err)
+		is.Equal(5, len(keys))
+
+		for _, key := range keys {
+			_, err = oldProvider.Unwrap(ctx, key.DataKey)
+			is.NoErr(err)
+		}
+
+		err = db.Unscoped().Delete(&database.Key{Fingerprint: "z"}).Error
+		is.NoErr(err)
+	}
+
+	// soft-deleted keys still need to be rotated
+	err = db.Delete(&database.Key{Fingerprint: "a"}).Error
+	is.NoErr(err)
+
+	progress := make([]encryption.Progress, 0)
+	err = encryption.RotateRootKey(ctx, db, oldProvider, newProvider,
+		encryption.WithBatchSize(2),
+		encryption.WithProgress(func(p encryption.Progress) { progress = append(progress, p) }),
+	)
+	is.NoErr(err)
+	is.Equal(3, len(progress))
+	is.Equal(int64(5), progress[2].Processed)
+	is.Equal(int64(5), progress[2].Updated)
+
+	keys := make([]database.Key, 0)
+	err = db.Unscoped().Find(&keys).Error
+	is.NoErr(err)
+	is.Equal(5, len(keys))
+
+	for _, key := range keys {
+		_, err = newProvider.Unwrap(ctx, key.DataKey)
+		is.NoErr(err)
+	}
+
+	// resuming from a cursor or re-running the rotation skips keys that have already been rotated
+	cursor := progress[0].Cursor
+	progress = progress[:0]
+	err = encryption.RotateRootKey(ctx, db, oldProvider, newProvider,
+		encryption.WithCursor(cursor),
+		encryption.WithProgress(func(p encryption.Progress) { progress = append(progress, p) }),
+	)
+	is.NoErr(err)
+	is.Equal(1, len(progress))
+	is.Equal(int64(3), progress[0].Processed)
+	is.Equal(int64(0), progress[0].Updated)
+
+	// data remains readable using the new root key. a new connection is used since gorm caches serializers on the schema
+	db, err = gorm.Open(sqlite.Open("file:rotation?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db,
+		encryption.WithKey(newKey),
+		encryption.WithMarshaling(json.Marshal, json.Unmarshal),
+	)
+	is.NoErr(err)
+
+	decoded := &testAESGCMRecord{}
+	err = db.First(decoded).Error
+	is.NoErr(err)
+	is.Equal(expected.Bytes, decoded.Bytes)
+}
+
+type testRotatedRecord struct {
+	ID     int    `gorm:"primaryKey;autoIncrement"`
+	Shared []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Record []byte `gorm:"type:bytes;serializer:aes-gcm-record"`
+}
+
+func TestRotateRootKeyRecordKeys(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:rotation_record_keys?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	oldKey, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	newKey, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	oldProvider := encryption.LocalKeyProvider(oldKey)
+	newProvider := encryption.LocalKeyProvider(newKey)
+
+	_, err = encryption.Register(db, encryption.WithKey(oldKey), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testRotatedRecord{})
+	is.NoErr(err)
+
+	records := []*testRotatedRecord{
+		{Shared: []byte("shared-0"), Record: []byte("record-0")},
+		{Shared: []byte("shared-1"), Record: []byte("record-1")},
+		{Shared: []byte("shared-2"), Record: []byte("record-2")},
+	}
+
+	err = db.Create(records).Error
+	is.NoErr(err)
+
+	// record keys that cannot be unwrapped prevent the rotation from committing anything, including the shared keys
+	unknownKey, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	wrapped, err := encryption.LocalKeyProvider(unknownKey).Wrap(ctx, unknownKey)
+	is.NoErr(err)
+
+	err = db.Create(&database.RecordKey{Fingerprint: "z", Table: "unknown", RecordID: "1", DataKey: wrapped}).Error
+	is.NoErr(err)
+
+	err = encryption.RotateRootKey(ctx, db, oldProvider, newProvider)
+	is.True(err != nil)
+
+	sharedKeys := make([]database.Key, 0)
+	err = db.Find(&sharedKeys).Error
+	is.NoErr(err)
+	is.Equal(1, len(sharedKeys))
+
+	_, err = oldProvider.Unwrap(ctx, sharedKeys[0].DataKey)
+	is.NoErr(err)
+
+	err = db.Delete(&database.RecordKey{Fingerprint: "z"}).Error
+	is.NoErr(err)
+
+	// record keys are rotated after the shared keys, and reported using the same progress
+	progress := make([]encryption.Progress, 0)
+	err = encryption.RotateRootKey(ctx, db, oldProvider, newProvider,
+		encryption.WithBatchSize(2),
+		encryption.WithProgress(func(p encryption.Progress) { progress = append(progress, p) }),
+	)
+	is.NoErr(err)
+	is.Equal(3, len(progress))
+	is.Equal(int64(4), progress[2].Processed)
+	is.Equal(int64(4), progress[2].Updated)
+
+	cursor, ok := progress[1].Cursor.(encryption.RotationCursor)
+	is.True(ok)
+	is.Equal("encryption_record_keys", cursor.Table)
+
+	recordKeys := make([]database.RecordKey, 0)
+	err = db.Find(&recordKeys).Error
+	is.NoErr(err)
+	is.Equal(3, len(recordKeys))
+
+	for _, key := range recordKeys {
+		_, err = newProvider.Unwrap(ctx, key.DataKey)
+		is.NoErr(err)
+	}
+
+	// resuming from a cursor within the record keys skips the shared keys
+	progress = progress[:0]
+	err = encryption.RotateRootKey(ctx, db, oldProvider, newProvider,
+		encryption.WithCursor(cursor),
+		encryption.WithProgress(func(p encryption.Progress) { progress = append(progress, p) }),
+	)
+	is.NoErr(err)
+	is.Equal(1, len(progress))
+	is.Equal(int64(1), progress[0].Processed)
+	is.Equal(int64(0), progress[0].Updated)
+
+	// both kinds of values remain readable using only the new root key
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(newKey))
+	is.NoErr(err)
+
+	decoded := make([]testRotatedRecord, 0)
+	err = db.Order("id").Find(&decoded).Error
+	is.NoErr(err)
+	is.Equal(3, len(decoded))
+
+	for idx, record := range decoded {
+		is.Equal(records[idx].Shared, record.Shared)
+		is.Equal(records[idx].Record, record.Record)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/sealedbox"
+)
+
+type testSealedBoxRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Email []byte `gorm:"type:bytes;serializer:sealed-box"`
+}
+
+// testMigratedSealedBoxRecord moves the column of testSealedBoxRecord to the aes-gcm serializer.
+type testMigratedSealedBoxRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Email []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+func (testMigratedSealedBoxRecord) TableName() string {
+	return "test_sealed_box_records"
+}
+
+func TestSealedBox(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:sealedbox?mode=memory&cache=shared"
+
+	publicKey, privateKey, err := sealedbox.GenerateKey()
+	is.NoErr(err)
+
+	// writers are configured using only the public key
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	err = encryption.RegisterSealedBox(publicKey)
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testSealedBoxRecord{})
+	is.NoErr(err)
+
+	err = db.Create(&testSealedBoxRecord{Email: []byte("user@example.com")}).Error
+	is.NoErr(err)
+
+	var raw []byte
+	err = db.Table("test_sealed_box_records").Select("email").Where("id = ?", 1).Row().Scan(&raw)
+	is.NoErr(err)
+
+	algorithm, fingerprint, _ := database.ParseField(raw)
+	is.Equal(database.AlgorithmSealedBox.ID, algorithm)
+	is.Equal(sealedbox.Fingerprint(publicKey), fingerprint)
+
+	// and cannot read values back
+	unknown := &sealedbox.UnknownKeyError{}
+
+	err = db.First(&testSealedBoxRecord{}, 1).Error
+	is.True(errors.As(err, &unknown))
+
+	// readers are configured using the private key
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration(), encryption.WithPrivateKeys(privateKey))
+	is.NoErr(err)
+
+	record := testSealedBoxRecord{}
+	err = db.First(&record, 1).Error
+	is.NoErr(err)
+	is.Equal("user@example.com", string(record.Email))
+
+	// once read, values can be moved to another serializer using universal decryption
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithPrivateKeys(privateKey), encryption.WithUniversalDecryption())
+	is.NoErr(err)
+
+	err = encryption.Reencrypt(ctx, db, testMigratedSealedBoxRecord{}, nil)
+	is.NoErr(err)
+
+	err = db.Table("test_sealed_box_records").Select("email").Where("id = ?", 1).Row().Scan(&raw)
+	is.NoErr(err)
+
+	algorithm, _, _ = database.ParseField(raw)
+	is.Equal(database.AlgorithmAESGCM.ID, algorithm)
+
+	migrated := testMigratedSealedBoxRecord{}
+	err = db.First(&migrated, 1).Error
+	is.NoErr(err)
+	is.Equal("user@example.com", string(migrated.Email))
+
+	// invalid keys are rejected when registering
+	err = encryption.RegisterSealedBox(publicKey[:16])
+	is.True(err != nil)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithPrivateKeys(privateKey[:16]))
+	is.True(err != nil)
+}
+
+func TestSealedBoxManager(t *testing.T) {
+	is := is.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:sealedbox_manager?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	_, privateKey, err := sealedbox.GenerateKey()
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	manager, err := encryption.Register(db, encryption.WithKey(key), encryption.WithMigration(), encryption.WithPrivateKeys(privateKey))
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testSealedBoxRecord{})
+	is.NoErr(err)
+
+	record := &testSealedBoxRecord{Email: []byte("user@example.com")}
+	err = db.Create(record).Error
+	is.NoErr(err)
+
+	err = db.First(&testSealedBoxRecord{}, record.ID).Error
+	is.NoErr(err)
+
+	// sealed-box values are included in the manager's usage
+	stats := manager.Stats()
+	is.Equal(int64(1), stats.Encrypted)
+	is.Equal(int64(1), stats.Decrypted)
+
+	// closing the manager erases the private keys and prevents the serializer from being used
+	err = manager.Close()
+	is.NoErr(err)
+
+	err = db.Create(&testSealedBoxRecord{Email: []byte("other@example.com")}).Error
+	is.True(errors.Is(err, encryption.ErrClosed))
+
+	err = db.First(&testSealedBoxRecord{}, record.ID).Error
+	is.True(errors.Is(err, encryption.ErrClosed))
+}
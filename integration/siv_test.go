@@ -0,0 +1,147 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	stdaes "crypto/aes"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/aes"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+// legacyAES is the ID of the legacy aes algorithm, which encrypted each block independently.
+const legacyAES = byte(1)
+
+// legacyEncrypt encrypts the plaintext using the legacy aes algorithm.
+func legacyEncrypt(is *is.I, key, plaintext []byte) []byte {
+	block, err := stdaes.NewCipher(key)
+	is.NoErr(err)
+
+	ciphertext := make([]byte, len(plaintext))
+	for idx := 0; idx < len(plaintext); idx += block.BlockSize() {
+		block.Encrypt(ciphertext[idx:], plaintext[idx:])
+	}
+
+	return database.FormatField(legacyAES, aes.Fingerprint(key), ciphertext)
+}
+
+type testSIVRecord struct {
+	ID     int    `gorm:"primaryKey;autoIncrement"`
+	Value  []byte `gorm:"type:bytes;serializer:aes"`
+	Secret []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+func TestLegacyAESMigration(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:siv?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	provider := encryption.LocalKeyProvider(key)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testSIVRecord{})
+	is.NoErr(err)
+
+	// simulate data written before AES-SIV was introduced
+	dataKey := database.Key{}
+	err = db.First(&dataKey).Error
+	is.NoErr(err)
+
+	unwrapped, err := provider.Unwrap(ctx, dataKey.DataKey)
+	is.NoErr(err)
+
+	err = db.Model(&dataKey).Update("data_key", legacyEncrypt(is, key, unwrapped)).Error
+	is.NoErr(err)
+
+	err = db.Create(&testSIVRecord{Secret: []byte("secret")}).Error
+	is.NoErr(err)
+
+	value := []byte("a unique value!!")
+	err = db.Model(&testSIVRecord{}).Where("id = ?", 1).UpdateColumn("value", gorm.Expr("?", legacyEncrypt(is, key, value))).Error
+	is.NoErr(err)
+
+	// legacy values and data keys remain readable
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key))
+	is.NoErr(err)
+
+	decoded := &testSIVRecord{}
+	err = db.First(decoded, 1).Error
+	is.NoErr(err)
+	is.Equal(value, decoded.Value)
+	is.Equal("secret", string(decoded.Secret))
+
+	// re-wrapping data keys using the same root key migrates them off the legacy algorithm
+	progress := make([]encryption.Progress, 0)
+	err = encryption.RotateRootKey(ctx, db, provider, provider,
+		encryption.WithProgress(func(p encryption.Progress) { progress = append(progress, p) }),
+	)
+	is.NoErr(err)
+	is.Equal(1, len(progress))
+	is.Equal(int64(1), progress[0].Updated)
+
+	err = db.First(&dataKey).Error
+	is.NoErr(err)
+
+	algorithm, _, _ := database.ParseField(dataKey.DataKey)
+	is.True(algorithm != legacyAES)
+
+	progress = progress[:0]
+	err = encryption.RotateRootKey(ctx, db, provider, provider,
+		encryption.WithProgress(func(p encryption.Progress) { progress = append(progress, p) }),
+	)
+	is.NoErr(err)
+	is.Equal(int64(0), progress[0].Updated)
+
+	// columns are migrated by re-encrypting them
+	remaining, err := encryption.CountRemaining(ctx, db, testSIVRecord{}, []string{"value"})
+	is.NoErr(err)
+	is.Equal(map[string]int64{aes.Fingerprint(key): 1}, remaining)
+
+	err = encryption.Reencrypt(ctx, db, testSIVRecord{}, []string{"value"})
+	is.NoErr(err)
+
+	remaining, err = encryption.CountRemaining(ctx, db, testSIVRecord{}, []string{"value"})
+	is.NoErr(err)
+	is.Equal(0, len(remaining))
+
+	raw := make([]byte, 0)
+	err = db.Table("test_siv_records").Select("value").Where("id = ?", 1).Row().Scan(&raw)
+	is.NoErr(err)
+
+	algorithm, _, _ = database.ParseField(raw)
+	is.True(algorithm != legacyAES)
+
+	// values are deterministic, so equal values produce the same ciphertext
+	err = db.Create(&testSIVRecord{Value: value}).Error
+	is.NoErr(err)
+
+	count := int64(0)
+	err = db.Table("test_siv_records").Where("value = ?", raw).Count(&count).Error
+	is.NoErr(err)
+	is.Equal(int64(2), count)
+
+	decoded = &testSIVRecord{}
+	err = db.First(decoded, 1).Error
+	is.NoErr(err)
+	is.Equal(value, decoded.Value)
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testStreamRecord struct {
+	ID       string `gorm:"primaryKey"`
+	Document []byte `gorm:"type:bytes;serializer:aes-gcm-stream;aad"`
+	Upload   []byte `gorm:"type:bytes;serializer:aes-gcm-stream"`
+}
+
+func TestStreaming(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:stream?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	manager, err := encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testStreamRecord{})
+	is.NoErr(err)
+
+	raw := func(id, column string) []byte {
+		var value []byte
+		err := db.Table("test_stream_records").Select(column).Where("id = ?", id).Row().Scan(&value)
+		is.NoErr(err)
+
+		return value
+	}
+
+	// values spanning any number of chunks can be written and read using the serializer
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 3 * 64 * 1024, 1 << 20} {
+		document := make([]byte, size)
+		_, err = rand.Read(document)
+		is.NoErr(err)
+
+		id := string(rune('a' + size%26))
+
+		err = db.Save(&testStreamRecord{ID: id, Document: document}).Error
+		is.NoErr(err)
+
+		algorithm, flags, _, _ := database.ParseFlaggedField(raw(id, "document"))
+		is.Equal(database.AlgorithmAESGCMStream.ID, algorithm)
+		is.Equal(database.FlagColumnAAD|database.FlagRowAAD, flags)
+
+		decoded := testStreamRecord{}
+		err = db.First(&decoded, "id = ?", id).Error
+		is.NoErr(err)
+		is.True(bytes.Equal(document, decoded.Document))
+
+		err = db.Delete(&testStreamRecord{}, "id = ?", id).Error
+		is.NoErr(err)
+	}
+
+	// large values can be encrypted without holding them in memory
+	document := make([]byte, 1<<20+123)
+	_, err = rand.Read(document)
+	is.NoErr(err)
+
+	encrypted := &bytes.Buffer{}
+
+	writer, err := manager.NewWriter(ctx, encrypted)
+	is.NoErr(err)
+
+	_, err = io.CopyBuffer(writer, bytes.NewReader(document), make([]byte, 1000))
+	is.NoErr(err)
+	is.NoErr(writer.Close())
+
+	reader, err := manager.NewReader(ctx, bytes.NewReader(encrypted.Bytes()))
+	is.NoErr(err)
+
+	decrypted, err := io.ReadAll(reader)
+	is.NoErr(err)
+	is.True(bytes.Equal(document, decrypted))
+
+	// streamed values can be stored and read using the serializer
+	err = db.Create(&testStreamRecord{ID: "streamed"}).Error
+	is.NoErr(err)
+
+	err = db.Table("test_stream_records").Where("id = ?", "streamed").Update("upload", encrypted.Bytes()).Error
+	is.NoErr(err)
+
+	decoded := testStreamRecord{}
+	err = db.First(&decoded, "id = ?", "streamed").Error
+	is.NoErr(err)
+	is.True(bytes.Equal(document, decoded.Upload))
+
+	// and values written using the serializer can be streamed
+	err = db.Save(&testStreamRecord{ID: "streamed", Document: []byte("document"), Upload: []byte("upload")}).Error
+	is.NoErr(err)
+
+	reader, err = manager.NewReader(ctx, bytes.NewReader(raw("streamed", "upload")))
+	is.NoErr(err)
+
+	decrypted, err = io.ReadAll(reader)
+	is.NoErr(err)
+	is.Equal("upload", string(decrypted))
+
+	// values bound to their row can only be read by the serializer
+	_, err = manager.NewReader(ctx, bytes.NewReader(raw("streamed", "document")))
+	is.True(err != nil)
+
+	// tampered, truncated, or extended streams fail to decrypt. The header of the field includes a 43 byte
+	// fingerprint and is followed by a 32 byte salt.
+	header := len(database.FormatField(database.AlgorithmAESGCMStream.ID, "", nil)) + 43
+	chunk := 64*1024 + 16
+
+	tampered := bytes.Clone(encrypted.Bytes())
+	tampered[len(tampered)/2] ^= 1
+
+	for _, invalid := range [][]byte{
+		tampered,
+		encrypted.Bytes()[:header+32+chunk],
+		encrypted.Bytes()[:encrypted.Len()-1],
+		append(bytes.Clone(encrypted.Bytes()), 0),
+	} {
+		reader, err = manager.NewReader(ctx, bytes.NewReader(invalid))
+		is.NoErr(err)
+
+		_, err = io.ReadAll(reader)
+		is.True(err != nil)
+	}
+
+	// values are encrypted using the shared data keys, so they're up to date
+	remaining, err := encryption.CountRemaining(ctx, db, testStreamRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(0, len(remaining))
+
+	stats := manager.Stats()
+	is.True(stats.Encrypted > 0)
+	is.True(stats.Decrypted > 0)
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func tenantOf(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+type testTenantRecord struct {
+	ID    int    `gorm:"primaryKey;autoIncrement"`
+	Value []byte `gorm:"type:bytes;serializer:aes-gcm"`
+}
+
+func TestTenants(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:tenants?mode=memory&cache=shared"))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	manager, err := encryption.Register(db,
+		encryption.WithKey(key),
+		encryption.WithMigration(),
+		encryption.WithCacheDuration(time.Millisecond),
+		encryption.WithTenantResolver(tenantOf),
+	)
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testTenantRecord{})
+	is.NoErr(err)
+
+	a := &testTenantRecord{Value: []byte("a")}
+	err = db.WithContext(withTenant(ctx, "a")).Create(a).Error
+	is.NoErr(err)
+
+	b := &testTenantRecord{Value: []byte("b")}
+	err = db.WithContext(withTenant(ctx, "b")).Create(b).Error
+	is.NoErr(err)
+
+	keys := make([]database.Key, 0)
+	err = db.Order("tenant").Find(&keys).Error
+	is.NoErr(err)
+	is.Equal(2, len(keys))
+	is.Equal("a", keys[0].Tenant)
+	is.Equal("b", keys[1].Tenant)
+
+	read := func(tenant string, id int) ([]byte, error) {
+		record := &testTenantRecord{}
+		err := db.WithContext(withTenant(ctx, tenant)).First(record, id).Error
+		return record.Value, err
+	}
+
+	value, err := read("a", a.ID)
+	is.NoErr(err)
+	is.Equal("a", string(value))
+
+	// tenants cannot decrypt each other's values
+	mismatch := &encryption.TenantMismatchError{}
+
+	_, err = read("b", a.ID)
+	is.True(errors.As(err, &mismatch))
+	is.Equal("b", mismatch.Tenant)
+
+	// values referencing keys that don't exist at all are reported differently
+	err = db.Model(&testTenantRecord{}).Where("id = ?", b.ID).
+		Update("value", database.FormatField(database.AlgorithmAESGCM.ID, "missing", []byte("ciphertext"))).Error
+	is.NoErr(err)
+
+	_, err = read("b", b.ID)
+	is.True(errors.Is(err, gorm.ErrRecordNotFound))
+
+	b = &testTenantRecord{ID: b.ID, Value: []byte("b")}
+	err = db.WithContext(withTenant(ctx, "b")).Save(b).Error
+	is.NoErr(err)
+
+	// crypto-shredding a tenant leaves other tenants untouched
+	err = encryption.DestroyTenantKeys(ctx, db, "a")
+	is.NoErr(err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = read("a", a.ID)
+	is.True(errors.Is(err, encryption.ErrKeyDestroyed))
+
+	value, err = read("b", b.ID)
+	is.NoErr(err)
+	is.Equal("b", string(value))
+
+	// new values for the shredded tenant are encrypted using a new key
+	c := &testTenantRecord{Value: []byte("c")}
+	err = db.WithContext(withTenant(ctx, "a")).Create(c).Error
+	is.NoErr(err)
+
+	value, err = read("a", c.ID)
+	is.NoErr(err)
+	is.Equal("c", string(value))
+
+	// the keys of tenants that are no longer writing values are evicted
+	time.Sleep(5 * time.Millisecond)
+
+	for _, tenant := range []string{"a", "b"} {
+		err = db.WithContext(withTenant(ctx, tenant)).Create(&testTenantRecord{Value: []byte(tenant)}).Error
+		is.NoErr(err)
+	}
+
+	is.Equal(int64(2), manager.Stats().ActiveKeys)
+
+	time.Sleep(5 * time.Millisecond)
+
+	err = db.WithContext(withTenant(ctx, "a")).Create(&testTenantRecord{Value: []byte("d")}).Error
+	is.NoErr(err)
+	is.Equal(int64(1), manager.Stats().ActiveKeys)
+}
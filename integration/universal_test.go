@@ -0,0 +1,156 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package integration_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/matryer/is"
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+type testUniversalRecord struct {
+	ID     int    `gorm:"primaryKey;autoIncrement"`
+	Value  []byte `gorm:"type:bytes;serializer:aes"`
+	Other  []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Secret []byte `gorm:"type:bytes;serializer:aes-gcm-record"`
+	Custom []byte `gorm:"type:bytes;serializer:xor"`
+}
+
+// testMigratedUniversalRecord changes the serializer of every column of testUniversalRecord.
+type testMigratedUniversalRecord struct {
+	ID     int    `gorm:"primaryKey;autoIncrement"`
+	Value  []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Other  []byte `gorm:"type:bytes;serializer:xchacha20poly1305"`
+	Secret []byte `gorm:"type:bytes;serializer:aes-gcm"`
+	Custom []byte `gorm:"type:bytes;serializer:aes"`
+}
+
+func (testMigratedUniversalRecord) TableName() string {
+	return "test_universal_records"
+}
+
+func TestUniversalDecryption(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	dsn := "file:universal?mode=memory&cache=shared"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	key, err := encryption.GenerateKey()
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithMigration())
+	is.NoErr(err)
+
+	err = encryption.RegisterAlgorithm(database.Algorithm{ID: 200, Name: "xor", Cipher: xorCipher(0x5a)})
+	is.NoErr(err)
+
+	err = db.AutoMigrate(testUniversalRecord{})
+	is.NoErr(err)
+
+	for idx := 0; idx < 2; idx++ {
+		err = db.Create(&testUniversalRecord{
+			Value:  []byte("value"),
+			Other:  []byte("other"),
+			Secret: []byte("secret"),
+			Custom: []byte("custom"),
+		}).Error
+		is.NoErr(err)
+	}
+
+	algorithms := func(id int) []byte {
+		values := make([][]byte, 4)
+		err := db.Table("test_universal_records").
+			Select("value", "other", "secret", "custom").
+			Where("id = ?", id).
+			Row().
+			Scan(&values[0], &values[1], &values[2], &values[3])
+		is.NoErr(err)
+
+		ids := make([]byte, 0, len(values))
+		for _, value := range values {
+			algorithm, _, _ := database.ParseField(value)
+			ids = append(ids, algorithm)
+		}
+
+		return ids
+	}
+
+	previous := algorithms(1)
+
+	expected := func(record testMigratedUniversalRecord) {
+		is.Equal("value", string(record.Value))
+		is.Equal("other", string(record.Other))
+		is.Equal("secret", string(record.Secret))
+		is.Equal("custom", string(record.Custom))
+	}
+
+	// without universal decryption, changing the serializer of a column leaves existing values unreadable
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key))
+	is.NoErr(err)
+
+	err = db.First(&testMigratedUniversalRecord{}, 1).Error
+	is.True(err != nil)
+
+	// with universal decryption, values are read using the algorithm that wrote them
+	db, err = gorm.Open(sqlite.Open(dsn))
+	is.NoErr(err)
+
+	_, err = encryption.Register(db, encryption.WithKey(key), encryption.WithUniversalDecryption())
+	is.NoErr(err)
+
+	records := make([]testMigratedUniversalRecord, 0)
+	err = db.Order("id").Find(&records).Error
+	is.NoErr(err)
+	is.Equal(2, len(records))
+
+	for _, record := range records {
+		expected(record)
+	}
+
+	// rows are migrated as they're rewritten
+	err = db.Save(&records[0]).Error
+	is.NoErr(err)
+
+	migrated := algorithms(1)
+	is.Equal(previous, algorithms(2))
+
+	for idx := range migrated {
+		is.True(migrated[idx] != previous[idx])
+	}
+
+	decoded := testMigratedUniversalRecord{}
+	err = db.First(&decoded, 1).Error
+	is.NoErr(err)
+	expected(decoded)
+
+	// or all at once, using Reencrypt
+	remaining, err := encryption.CountRemaining(ctx, db, testMigratedUniversalRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(4, len(remaining))
+
+	err = encryption.Reencrypt(ctx, db, testMigratedUniversalRecord{}, nil)
+	is.NoErr(err)
+
+	remaining, err = encryption.CountRemaining(ctx, db, testMigratedUniversalRecord{}, nil)
+	is.NoErr(err)
+	is.Equal(0, len(remaining))
+	is.Equal(migrated, algorithms(2))
+
+	decoded = testMigratedUniversalRecord{}
+	err = db.First(&decoded, 2).Error
+	is.NoErr(err)
+	expected(decoded)
+}
@@ -0,0 +1,301 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package aesgcm
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+// aadTagSetting is the gorm tag setting used to bind the values of a field to where they're stored. Using "aad" binds
+// values to their table, column, and the primary key of their row, while "aad:column" leaves out the primary key.
+// Adding "required", as in "aad:required" or "aad:column,required", rejects values that aren't bound, including values
+// written before the setting was added and plaintext values.
+const aadTagSetting = "AAD"
+
+// aadSetting parses the aad tag setting of the field, returning the flags describing the associated data its values
+// are bound to and whether values missing those flags are rejected.
+func aadSetting(field *schema.Field) (byte, bool) {
+	if field == nil || field.Schema == nil {
+		return 0, false
+	}
+
+	setting, ok := field.TagSettings[aadTagSetting]
+	if !ok {
+		return 0, false
+	}
+
+	flags := database.FlagColumnAAD | database.FlagRowAAD
+	required := false
+
+	for _, option := range strings.Split(setting, ",") {
+		switch strings.ToLower(strings.TrimSpace(option)) {
+		case "column":
+			flags = database.FlagColumnAAD
+		case "required":
+			required = true
+		}
+	}
+
+	return flags, required
+}
+
+// aadFlags returns the flags describing the associated data that new values of the field should be bound to. Values are
+// only bound to the primary key of their row when it's known before the value is written. Rows whose primary key is
+// assigned by the database while being created are bound once it's known, see RegisterCallbacks. Otherwise, fields
+// requiring their values to be bound return an error, while the rest are only bound to their table and column until
+// they're saved again.
+func aadFlags(ctx context.Context, field *schema.Field, row reflect.Value) (byte, error) {
+	flags, required := aadSetting(field)
+	if flags&database.FlagRowAAD == 0 {
+		return flags, nil
+	}
+
+	if _, ok := primaryKeyOf(ctx, field, row); ok {
+		return flags, nil
+	}
+
+	// rows created without a primary key are bound once the database has assigned one
+	row = reflect.Indirect(row)
+	if scope, ok := ctx.Value(aadScopeKey{}).(aadScope); ok && row.CanAddr() && scope[row.Addr().Pointer()] {
+		return database.FlagColumnAAD, nil
+	}
+
+	if required {
+		return 0, fmt.Errorf("the primary key of %s is required to encrypt %s", field.Schema.Table, field.DBName)
+	}
+
+	return database.FlagColumnAAD, nil
+}
+
+// requireAAD returns an error when the field requires its values to be bound, but the value was written without the
+// flags describing the expected associated data. Values that aren't encrypted have no fingerprint and are rejected.
+func requireAAD(field *schema.Field, fingerprint string, flags byte) error {
+	expected, required := aadSetting(field)
+	if required && (fingerprint == "" || flags&expected != expected) {
+		return fmt.Errorf("%s of %s requires values bound using associated data", field.DBName, field.Schema.Table)
+	}
+
+	return nil
+}
+
+// associatedData builds the associated data described by the flags. The flags themselves are always included, so they
+// cannot be changed without failing to decrypt the value. Values written without flags use no associated data. Each
+// component is prefixed with its length so values from different tables, columns, and rows can never produce the same
+// associated data.
+func associatedData(ctx context.Context, field *schema.Field, row reflect.Value, flags byte) ([]byte, error) {
+	switch {
+	case flags == 0:
+		return nil, nil
+	case flags&database.FlagColumnAAD == 0:
+		return []byte{flags}, nil
+	case field == nil || field.Schema == nil:
+		return nil, fmt.Errorf("associated data requires a schema")
+	}
+
+	components := []string{field.Schema.Table, field.DBName}
+
+	if flags&database.FlagRowAAD != 0 {
+		primaryKey, ok := primaryKeyOf(ctx, field, row)
+		if !ok {
+			return nil, fmt.Errorf("the primary key of %s is required to decrypt %s", field.Schema.Table, field.DBName)
+		}
+
+		components = append(components, primaryKey)
+	}
+
+	aad := []byte{flags}
+	for _, component := range components {
+		aad = binary.AppendUvarint(aad, uint64(len(component)))
+		aad = append(aad, component...)
+	}
+
+	return aad, nil
+}
+
+// primaryKeyOf returns the primary key of the row containing the field, provided it's known.
+func primaryKeyOf(ctx context.Context, field *schema.Field, row reflect.Value) (string, bool) {
+	primaryKey := field.Schema.PrioritizedPrimaryField
+	if primaryKey == nil || !row.IsValid() {
+		return "", false
+	}
+
+	row = reflect.Indirect(row)
+	if !row.IsValid() || row.Type() != field.Schema.ModelType {
+		return "", false
+	}
+
+	value, zero := primaryKey.ValueOf(ctx, row)
+	if zero {
+		return "", false
+	}
+
+	return fmt.Sprint(value), true
+}
+
+const (
+	aadCreateCallback = "encryption:aad_create"
+	aadBindCallback   = "encryption:aad_bind"
+)
+
+// aadScopeKey is used to attach an aadScope to the context of a statement.
+type aadScopeKey struct{}
+
+// aadScope contains the rows being created whose primary key is assigned by the database, indexed by their address.
+type aadScope map[uintptr]bool
+
+// RegisterCallbacks registers the callbacks that bind the values of rows being created to their primary key once it
+// has been assigned by the database. Values are re-encrypted within the same transaction as the statement creating the
+// rows.
+func (s *Serializer) RegisterCallbacks(db *gorm.DB) error {
+	// callbacks are replaced rather than registered so the serializer can be registered multiple times for a database
+	create := db.Callback().Create()
+
+	err := create.After("gorm:before_create").Before("gorm:create").Replace(aadCreateCallback, s.prepareRows)
+	if err != nil {
+		return err
+	}
+
+	return create.After("gorm:create").Before("gorm:commit_or_rollback_transaction").Replace(aadBindCallback, s.bindRows)
+}
+
+// RemoveCallbacks removes the callbacks registered by RegisterCallbacks from the provided database.
+func (s *Serializer) RemoveCallbacks(db *gorm.DB) error {
+	create := db.Callback().Create()
+
+	err := create.Remove(aadCreateCallback)
+	if err != nil {
+		return err
+	}
+
+	return create.Remove(aadBindCallback)
+}
+
+// rowBoundFields returns the fields written by the statement whose values are bound to the primary key of their row,
+// including fields encrypted using record keys.
+func rowBoundFields(stmt *gorm.Statement) []*schema.Field {
+	if stmt.Schema == nil || stmt.Schema.PrioritizedPrimaryField == nil {
+		return nil
+	}
+
+	selected, restricted := stmt.SelectAndOmitColumns(true, false)
+
+	fields := make([]*schema.Field, 0)
+	for _, field := range stmt.Schema.Fields {
+		switch field.Serializer.(type) {
+		case *Serializer, *RecordSerializer:
+		default:
+			continue
+		}
+
+		if field.DBName == "" {
+			continue
+		}
+
+		if include, ok := selected[field.DBName]; (ok && !include) || (!ok && restricted) {
+			continue
+		}
+
+		if flags, _ := aadSetting(field); flags&database.FlagRowAAD != 0 {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// prepareRows records the rows being created whose primary key has yet to be assigned, provided they contain fields
+// bound to their row.
+func (s *Serializer) prepareRows(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || len(rowBoundFields(stmt)) == 0 {
+		return
+	}
+
+	scope := aadScope{}
+
+	_ = eachRow(stmt, func(row reflect.Value) error {
+		if _, zero := stmt.Schema.PrioritizedPrimaryField.ValueOf(stmt.Context, row); zero {
+			scope[row.Addr().Pointer()] = true
+		}
+
+		return nil
+	})
+
+	if len(scope) > 0 {
+		stmt.Context = context.WithValue(stmt.Context, aadScopeKey{}, scope)
+	}
+}
+
+// bindRows re-encrypts the values of fields bound to their row once the database has assigned the primary key of the
+// rows recorded by prepareRows.
+func (s *Serializer) bindRows(db *gorm.DB) {
+	stmt := db.Statement
+
+	scope, ok := stmt.Context.Value(aadScopeKey{}).(aadScope)
+	if db.Error != nil || !ok {
+		return
+	}
+
+	fields := rowBoundFields(stmt)
+	primaryKey := stmt.Schema.PrioritizedPrimaryField
+
+	// use the statement's connection so values are bound within the same transaction as the record
+	txn := db.Session(&gorm.Session{NewDB: true})
+
+	err := eachRow(stmt, func(row reflect.Value) error {
+		if !scope[row.Addr().Pointer()] {
+			return nil
+		}
+
+		id, zero := primaryKey.ValueOf(stmt.Context, row)
+		if zero {
+			return fmt.Errorf("unable to determine primary key of record in %s", stmt.Schema.Table)
+		}
+
+		values := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			value, zero := field.ValueOf(stmt.Context, row)
+			if zero && field.HasDefaultValue {
+				continue
+			}
+
+			// serialize the value the same way gorm does, now that the primary key is known
+			valuer, ok := value.(driver.Valuer)
+			if !ok {
+				continue
+			}
+
+			serialized, err := valuer.Value()
+			if err != nil {
+				return err
+			}
+
+			values[field.DBName] = serialized
+		}
+
+		if len(values) == 0 {
+			return nil
+		}
+
+		return txn.Table(stmt.Schema.Table).
+			Where(clause.Eq{Column: clause.Column{Name: primaryKey.DBName}, Value: id}).
+			UpdateColumns(values).
+			Error
+	})
+
+	if err != nil {
+		_ = db.AddError(err)
+	}
+}
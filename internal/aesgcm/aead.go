@@ -0,0 +1,172 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package aesgcm
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"reflect"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+// suite describes the algorithm used to encrypt values and how its AEAD is constructed from a data key.
+type suite struct {
+	algorithm internal.Algorithm
+	newAEAD   func(key []byte) (cipher.AEAD, error)
+
+	// streamed suites encrypt values in chunks using a key derived for each value, see streamSuite.
+	streamed bool
+}
+
+// suites contains the algorithms that can be used with data keys stored in the encryption_keys table, indexed by ID.
+var suites = map[byte]suite{
+	internal.AES_GCM.ID:            {internal.AES_GCM, newAEAD, false},
+	internal.CHACHA20_POLY1305.ID:  {internal.CHACHA20_POLY1305, newChaCha20Poly1305, false},
+	internal.XCHACHA20_POLY1305.ID: {internal.XCHACHA20_POLY1305, newXChaCha20Poly1305, false},
+	internal.AES_GCM_STREAM.ID:     streamSuite,
+}
+
+// seal encrypts the plaintext using the data key, binding it to the associated data.
+func (s suite) seal(key *dataKey, plaintext, aad []byte) ([]byte, error) {
+	if s.streamed {
+		return sealStream(key.DataKey, plaintext, aad)
+	}
+
+	aead, err := key.aead(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return seal(aead, plaintext, aad)
+}
+
+// open decrypts a ciphertext produced by seal.
+func (s suite) open(key *dataKey, ciphertext, aad []byte) ([]byte, error) {
+	if s.streamed {
+		return openStream(key.DataKey, ciphertext, aad)
+	}
+
+	aead, err := key.aead(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(aead, ciphertext, aad)
+}
+
+// newAEAD constructs the AES+GCM AEAD for the provided key. Constructing the AEAD is relatively expensive, so it should
+// be done once per key and reused.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// newChaCha20Poly1305 constructs the ChaCha20+Poly1305 AEAD for the provided key.
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	derived, err := deriveKey(key, internal.CHACHA20_POLY1305)
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.New(derived)
+}
+
+// newXChaCha20Poly1305 constructs the XChaCha20+Poly1305 AEAD for the provided key. The extended 192bit nonce is large
+// enough for randomly generated nonces to never collide in practice, regardless of how many values use the same key.
+func newXChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	derived, err := deriveKey(key, internal.XCHACHA20_POLY1305)
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.NewX(derived)
+}
+
+// deriveKey derives a key specific to the algorithm from a data key using HKDF. Data keys are shared by every algorithm
+// using the encryption_keys table, so this keeps the same key from being used directly by more than one algorithm.
+// AES+GCM predates this and uses data keys directly.
+func deriveKey(key []byte, algorithm internal.Algorithm) ([]byte, error) {
+	derived := make([]byte, chacha20poly1305.KeySize)
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(algorithm.Name)), derived)
+	if err != nil {
+		return nil, err
+	}
+
+	return derived, nil
+}
+
+// seal encrypts the plaintext, prefixing the ciphertext with a randomly generated nonce. The ciphertext can only be
+// decrypted using the same associated data.
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+
+	ciphertext := make([]byte, nonceSize, nonceSize+len(plaintext)+aead.Overhead())
+
+	_, err := rand.Read(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(ciphertext, ciphertext, plaintext, aad), nil
+}
+
+// open decrypts a ciphertext produced by seal.
+func open(aead cipher.AEAD, ciphertext, aad []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+
+	return aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], aad)
+}
+
+// plaintextOf converts the in-memory field value into the plaintext that should be encrypted.
+func plaintextOf(marshaler func(any) ([]byte, error), fieldValue interface{}) ([]byte, error) {
+	switch v := fieldValue.(type) {
+	case []byte:
+		return v, nil
+	default:
+		return marshaler(v)
+	}
+}
+
+// setPlaintext sets the decrypted plaintext on the destination field.
+func setPlaintext(
+	ctx context.Context,
+	unmarshaler func([]byte, any) error,
+	field *schema.Field,
+	dst reflect.Value,
+	plaintext []byte,
+) error {
+	v := field.ReflectValueOf(ctx, dst)
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+		v.SetBytes(plaintext)
+	} else {
+		val := reflect.New(field.FieldType)
+		err := unmarshaler(plaintext, val.Interface())
+		if err != nil {
+			return err
+		}
+
+		v.Set(val.Elem())
+	}
+
+	return nil
+}
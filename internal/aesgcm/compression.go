@@ -0,0 +1,233 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package aesgcm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+// compressTagSetting is the gorm tag setting used to choose how the values of a field are compressed. Using "compress"
+// uses the configured algorithm (or zstd when none is configured), "compress:<algorithm>" selects an algorithm for the
+// field, and "compress:none" disables compression for the field.
+const compressTagSetting = "COMPRESS"
+
+// Compression configures how plaintexts are compressed before they're encrypted.
+type Compression struct {
+	// Algorithm names the algorithm used to compress values of fields that don't select one using the compress tag
+	// setting. Values are not compressed when empty.
+	Algorithm string
+
+	// Threshold is the size, in bytes, plaintexts must reach before they're compressed. Compressing tiny values costs
+	// more than it saves. Every value is compressed when the threshold isn't positive.
+	Threshold int
+
+	// MaxSize is the largest size, in bytes, a value may decompress to. Values that would grow beyond it fail to be
+	// read rather than exhausting memory. Values of any size are decompressed when it isn't positive.
+	MaxSize int
+}
+
+// compressor compresses and decompresses plaintexts using a single algorithm.
+type compressor struct {
+	name       string
+	compress   func(plaintext []byte) ([]byte, error)
+	decompress func(compressed []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+
+	// zstdDecoders contains decoders limited to a maximum size, indexed by the size. Decoders are safe for concurrent
+	// use, and only a handful of sizes are ever configured, so they're kept for the lifetime of the process.
+	zstdDecoders sync.Map
+)
+
+// compressors contains the supported compression algorithms, indexed by the flag recording their use in the field
+// format.
+var compressors = map[byte]compressor{
+	database.FlagGzip: {
+		name:       "gzip",
+		compress:   gzipCompress,
+		decompress: gzipDecompress,
+	},
+	database.FlagZstd: {
+		name:       "zstd",
+		compress:   func(plaintext []byte) ([]byte, error) { return zstdEncoder.EncodeAll(plaintext, nil), nil },
+		decompress: zstdDecompress,
+	},
+	database.FlagSnappy: {
+		name:       "snappy",
+		compress:   func(plaintext []byte) ([]byte, error) { return snappy.Encode(nil, plaintext), nil },
+		decompress: snappyDecompress,
+	},
+}
+
+// compressionFlag returns the flag for the named compression algorithm. No flag is returned for "none".
+func compressionFlag(name string) (byte, error) {
+	if name == "" || strings.EqualFold(name, "none") {
+		return 0, nil
+	}
+
+	for flag, compressor := range compressors {
+		if strings.EqualFold(compressor.name, name) {
+			return flag, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown compression algorithm: %s", name)
+}
+
+// Validate returns an error when the configured algorithm is not supported.
+func (c Compression) Validate() error {
+	_, err := compressionFlag(c.Algorithm)
+	return err
+}
+
+// compress compresses the plaintext using the algorithm selected for the field, returning the flag recording the
+// algorithm used. Plaintexts smaller than the threshold, or that don't get any smaller, are returned as is.
+func (c Compression) compress(field *schema.Field, plaintext []byte) (byte, []byte, error) {
+	name := c.Algorithm
+
+	if field != nil {
+		setting, ok := field.TagSettings[compressTagSetting]
+		switch {
+		case ok && !strings.EqualFold(setting, compressTagSetting):
+			name = setting
+		case ok && name == "":
+			name = "zstd"
+		}
+	}
+
+	flag, err := compressionFlag(name)
+	if err != nil || flag == 0 || len(plaintext) < c.Threshold {
+		return 0, plaintext, err
+	}
+
+	compressed, err := compressors[flag].compress(plaintext)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(compressed) >= len(plaintext) {
+		return 0, plaintext, nil
+	}
+
+	return flag, compressed, nil
+}
+
+// decompress reverses compress using the algorithm recorded in the flags. Values are only decompressed once they've
+// been authenticated, so only values written using the data key are ever decompressed. An error is returned when the
+// value would decompress to more than the maximum size.
+func (c Compression) decompress(flags byte, plaintext []byte) ([]byte, error) {
+	flags &= database.FlagGzip | database.FlagZstd | database.FlagSnappy
+	if flags == 0 {
+		return plaintext, nil
+	}
+
+	compressor, ok := compressors[flags]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression flags: %08b", flags)
+	}
+
+	return compressor.decompress(plaintext, c.MaxSize)
+}
+
+// errMaxSize returns the error reported when a value decompresses to more than the maximum size.
+func errMaxSize(maxSize int) error {
+	return fmt.Errorf("decompressed value exceeds the maximum size of %d bytes", maxSize)
+}
+
+func gzipCompress(plaintext []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+
+	_, err := writer.Write(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(compressed []byte, maxSize int) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	if maxSize <= 0 {
+		return io.ReadAll(reader)
+	}
+
+	// read a single byte past the maximum to tell values of exactly the maximum size apart from larger ones
+	plaintext, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plaintext) > maxSize {
+		return nil, errMaxSize(maxSize)
+	}
+
+	return plaintext, nil
+}
+
+func zstdDecompress(compressed []byte, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		return zstdDecoder.DecodeAll(compressed, nil)
+	}
+
+	decoder, ok := zstdDecoders.Load(maxSize)
+	if !ok {
+		created, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		if err != nil {
+			return nil, err
+		}
+
+		decoder, ok = zstdDecoders.LoadOrStore(maxSize, created)
+		if ok {
+			created.Close()
+		}
+	}
+
+	plaintext, err := decoder.(*zstd.Decoder).DecodeAll(compressed, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, errMaxSize(maxSize)
+	}
+
+	return plaintext, err
+}
+
+func snappyDecompress(compressed []byte, maxSize int) ([]byte, error) {
+	// the decoded length is recorded ahead of the value, and decoding fails when the value doesn't match it
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize > 0 && size > maxSize {
+		return nil, errMaxSize(maxSize)
+	}
+
+	return snappy.Decode(nil, compressed)
+}
@@ -0,0 +1,365 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package aesgcm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+// prefetchScopeKey is used to attach a prefetchScope to the context of a statement.
+type prefetchScopeKey struct{}
+
+// prefetchScope contains the data keys loaded for a single statement, indexed by fingerprint. Keys are held for the
+// lifetime of the statement so they aren't evicted from the cache before the rows using them are deserialized.
+type prefetchScope map[string]*dataKey
+
+// prefetchBatchSize is the number of rows buffered at a time while prefetching the data keys they reference.
+const prefetchBatchSize = 1000
+
+// RegisterPrefetch replaces the query callback of the provided database with one that loads the data keys referenced by
+// the result of a query before its rows are deserialized. Rows are buffered in batches, loading all keys missing from
+// the cache for each batch using a single query. This is only done for models containing fields encrypted using data
+// keys. The replacement mirrors gorm's default query callback, so an error is returned when the callback has already
+// been replaced by another plugin rather than silently dropping its behavior.
+func (s *Serializer) RegisterPrefetch(db *gorm.DB) error {
+	query := db.Callback().Query()
+
+	if handler := query.Get("gorm:query"); handler != nil && !isQueryCallback(handler) {
+		return fmt.Errorf("gorm:query has been replaced by another plugin, data keys cannot be prefetched")
+	}
+
+	return query.Replace("gorm:query", s.query)
+}
+
+// RemovePrefetch restores gorm's default query callback on the provided database. The callback is left alone when it
+// has since been replaced by another plugin.
+func (s *Serializer) RemovePrefetch(db *gorm.DB) error {
+	query := db.Callback().Query()
+
+	if handler := query.Get("gorm:query"); handler == nil || !isPrefetchCallback(handler) {
+		return nil
+	}
+
+	return query.Replace("gorm:query", callbacks.Query)
+}
+
+// isQueryCallback reports whether the handler is gorm's default query callback or one registered by RegisterPrefetch.
+func isQueryCallback(handler func(*gorm.DB)) bool {
+	return isPrefetchCallback(handler) || reflect.ValueOf(handler).Pointer() == reflect.ValueOf(callbacks.Query).Pointer()
+}
+
+// isPrefetchCallback reports whether the handler was registered by RegisterPrefetch. Functions cannot be compared
+// directly, but every method value of query shares the same code pointer.
+func isPrefetchCallback(handler func(*gorm.DB)) bool {
+	return reflect.ValueOf(handler).Pointer() == reflect.ValueOf((&Serializer{}).query).Pointer()
+}
+
+// query mirrors the default gorm:query callback, wrapping the rows so data keys can be prefetched.
+func (s *Serializer) query(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+
+	if db.Statement.Schema == nil || len(db.Statement.Schema.FieldsByDBName) == 0 {
+		callbacks.Query(db)
+		return
+	}
+
+	callbacks.BuildQuerySQL(db)
+	if db.DryRun || db.Error != nil {
+		return
+	}
+
+	rows, err := db.Statement.ConnPool.QueryContext(db.Statement.Context, db.Statement.SQL.String(), db.Statement.Vars...)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+
+	defer func() {
+		_ = db.AddError(rows.Close())
+	}()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+
+	encrypted := make([]int, 0)
+	for idx, column := range columns {
+		field := db.Statement.Schema.FieldsByDBName[column]
+		if field == nil {
+			continue
+		}
+
+		if _, ok := field.Serializer.(*Serializer); ok {
+			encrypted = append(encrypted, idx)
+		}
+	}
+
+	if len(encrypted) == 0 {
+		gorm.Scan(rows, db, 0)
+		return
+	}
+
+	ctx := db.Statement.Context
+	scope := prefetchScope{}
+	db.Statement.Context = context.WithValue(ctx, prefetchScopeKey{}, scope)
+
+	defer func() {
+		db.Statement.Context = ctx
+	}()
+
+	gorm.Scan(&prefetchRows{
+		Rows:      rows,
+		batchSize: prefetchBatchSize,
+		prefetch: func(buffered [][]any) error {
+			fingerprints := make([]string, 0)
+			seen := make(map[string]bool)
+
+			for _, row := range buffered {
+				for _, idx := range encrypted {
+					value, ok := row[idx].(*any)
+					if !ok {
+						continue
+					}
+
+					var raw []byte
+					switch v := (*value).(type) {
+					case []byte:
+						raw = v
+					case string:
+						raw = []byte(v)
+					}
+
+					algorithm, fingerprint, _ := database.ParseField(raw)
+					if internal.KeyedAlgorithms[algorithm] && fingerprint != "" && !seen[fingerprint] {
+						seen[fingerprint] = true
+						fingerprints = append(fingerprints, fingerprint)
+					}
+				}
+			}
+
+			return s.prefetch(ctx, scope, fingerprints)
+		},
+	}, db, 0)
+}
+
+// prefetch adds the data keys for the provided fingerprints to the scope, loading any that are missing from the cache
+// using a single query. Keys that cannot be used, including those that fail to be unwrapped, are left out of the scope
+// so the error is reported when the value referencing them is deserialized. Keys that could not be found, or that
+// belong to another tenant, are added to the negative cache when enabled.
+func (s *Serializer) prefetch(ctx context.Context, scope prefetchScope, fingerprints []string) error {
+	tenant := s.tenant(ctx)
+	missing := make([]string, 0, len(fingerprints))
+
+	for _, fingerprint := range fingerprints {
+		cached, ok := s.cache.Get(fingerprint + "," + tenant)
+		if ok {
+			scope[fingerprint] = cached
+			continue
+		}
+
+		if s.missing != nil {
+			if _, ok := s.missing.Get(fingerprint + "," + tenant); ok {
+				continue
+			}
+		}
+
+		missing = append(missing, fingerprint)
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	s.usage.Misses.Add(int64(len(missing)))
+
+	keys := make([]*database.Key, 0, len(missing))
+
+	// soft-deleted keys may still be protecting data
+	err := s.db.WithContext(ctx).Unscoped().Where("fingerprint IN ?", missing).Find(&keys).Error
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]*database.Key, len(keys))
+	for _, key := range keys {
+		found[key.Fingerprint] = key
+	}
+
+	// keys are cached in the order they're referenced, so the most recently referenced keys are evicted last
+	for _, fingerprint := range missing {
+		key, ok := found[fingerprint]
+		if !ok {
+			if s.missing != nil {
+				s.missing.Add(fingerprint+","+tenant, gorm.ErrRecordNotFound)
+			}
+
+			continue
+		}
+
+		if key.Tenant != tenant {
+			if s.missing != nil {
+				mismatch := &database.TenantMismatchError{Fingerprint: key.Fingerprint, Tenant: tenant}
+				s.missing.Add(key.Fingerprint+","+tenant, mismatch)
+			}
+
+			continue
+		}
+
+		if key.Status == database.KeyDestroyed || key.Status == database.KeyRetired {
+			continue
+		}
+
+		key.DataKey, err = s.provider.Unwrap(ctx, key.DataKey)
+		if err != nil {
+			continue
+		}
+
+		cached, err := newDataKey(key, s.suite)
+		if err != nil {
+			continue
+		}
+
+		s.cache.Add(key.Fingerprint+","+tenant, cached)
+		scope[key.Fingerprint] = cached
+	}
+
+	return nil
+}
+
+// prefetchRows buffers a batch of rows the first time a row of the batch is scanned, allowing the data keys they
+// reference to be loaded before any of them are deserialized. Rows are then replayed into the destinations provided by
+// gorm. Only a single batch of the result is held in memory at a time.
+type prefetchRows struct {
+	gorm.Rows
+
+	prefetch  func(buffered [][]any) error
+	batchSize int
+
+	buffered [][]any
+	current  int
+	scanned  bool
+
+	// more is set when the underlying rows are positioned on a row following the buffered ones.
+	more bool
+}
+
+// Next advances to the next row, reading from the buffer once a batch has been buffered.
+func (r *prefetchRows) Next() bool {
+	if !r.scanned {
+		return r.Rows.Next()
+	}
+
+	r.current++
+	if r.current < len(r.buffered) {
+		return true
+	}
+
+	return r.more
+}
+
+// Scan copies the values of the current row into the provided destinations, buffering the next batch of rows when
+// the current one has been consumed.
+func (r *prefetchRows) Scan(dest ...any) error {
+	if r.current >= len(r.buffered) {
+		r.scanned = true
+
+		err := r.fill(dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return replayValues(r.buffered[r.current], dest)
+}
+
+// fill buffers a batch of rows, starting with the row the underlying rows are positioned on, and prefetches the data
+// keys they reference.
+func (r *prefetchRows) fill(dest []any) error {
+	r.buffered = r.buffered[:0]
+	r.current = 0
+
+	for {
+		values := bufferValues(dest)
+
+		err := r.Rows.Scan(values...)
+		if err != nil {
+			return err
+		}
+
+		r.buffered = append(r.buffered, values)
+		r.more = r.Rows.Next()
+
+		if !r.more || len(r.buffered) == r.batchSize {
+			break
+		}
+	}
+
+	if err := r.Rows.Err(); err != nil {
+		return err
+	}
+
+	return r.prefetch(r.buffered)
+}
+
+// bufferValues allocates values that can hold a row scanned into the provided destinations. Values destined for an
+// sql.Scanner are kept in their raw form so they can be passed to the scanner later, just as database/sql would.
+func bufferValues(dest []any) []any {
+	values := make([]any, len(dest))
+
+	for idx, d := range dest {
+		switch d.(type) {
+		case sql.Scanner:
+			values[idx] = new(any)
+		case *sql.RawBytes:
+			// raw bytes are only valid until the next row is read, so they need to be copied
+			values[idx] = new([]byte)
+		default:
+			rv := reflect.ValueOf(d)
+			if rv.Kind() != reflect.Ptr || rv.IsNil() {
+				values[idx] = d
+				continue
+			}
+
+			values[idx] = reflect.New(rv.Type().Elem()).Interface()
+		}
+	}
+
+	return values
+}
+
+// replayValues copies buffered values into the provided destinations.
+func replayValues(values []any, dest []any) error {
+	for idx, d := range dest {
+		switch d := d.(type) {
+		case sql.Scanner:
+			if err := d.Scan(*values[idx].(*any)); err != nil {
+				return err
+			}
+		case *sql.RawBytes:
+			*d = *values[idx].(*[]byte)
+		default:
+			rv := reflect.ValueOf(d)
+			if rv.Kind() != reflect.Ptr || rv.IsNil() {
+				continue
+			}
+
+			rv.Elem().Set(reflect.ValueOf(values[idx]).Elem())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,537 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package aesgcm
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+func NewRecord(
+	db *gorm.DB,
+	provider database.KeyProvider,
+	compression Compression,
+	marshaler func(any) ([]byte, error),
+	unmarshaler func([]byte, any) error,
+) *RecordSerializer {
+	return &RecordSerializer{
+		db:          db,
+		provider:    provider,
+		hmacKey:     fingerprintKey(provider),
+		usage:       &usage{},
+		compression: compression,
+		marshaler:   marshaler,
+		unmarshaler: unmarshaler,
+	}
+}
+
+// RecordSerializer provides a Gorm Serializer that encrypts each record using its own AES+GCM data key. Keys are stored
+// in the encryption_record_keys table alongside the table name and primary key of the record they protect, allowing a
+// single record to be crypto-shredded by deleting its keys. Keys are managed by a set of callbacks that must be
+// registered using RegisterCallbacks.
+type RecordSerializer struct {
+	db       *gorm.DB
+	provider database.KeyProvider
+	hmacKey  []byte
+	usage    *usage
+
+	compression Compression
+
+	// fallback reads values written using other algorithms, when configured.
+	fallback schema.SerializerInterface
+
+	marshaler   func(any) ([]byte, error)
+	unmarshaler func([]byte, any) error
+}
+
+// WithFallback returns a RecordSerializer that reads values written using other algorithms using the fallback, rather
+// than returning an error. The returned serializer shares its usage with this one.
+func (s *RecordSerializer) WithFallback(fallback schema.SerializerInterface) *RecordSerializer {
+	variant := *s
+	variant.fallback = fallback
+
+	return &variant
+}
+
+// recordScopeKey is used to attach a recordScope to the context of a statement.
+type recordScopeKey struct{}
+
+// recordScope tracks the record keys used by a single statement.
+type recordScope struct {
+	// rows contains the key used to encrypt each row, indexed by the address of the row.
+	rows map[uintptr]*database.RecordKey
+
+	// keys contains the AEAD constructed for each data key that has already been loaded, indexed by fingerprint.
+	keys map[string]cipher.AEAD
+}
+
+const (
+	recordCreateCallback = "encryption:record_keys_create"
+	recordAssignCallback = "encryption:record_keys_assign"
+	recordUpdateCallback = "encryption:record_keys_update"
+	recordQueryCallback  = "encryption:record_keys_query"
+)
+
+// RegisterCallbacks registers the callbacks that manage record keys for statements on the provided database. Keys are
+// created within the same transaction as the statement that writes the record.
+func (s *RecordSerializer) RegisterCallbacks(db *gorm.DB) error {
+	// callbacks are replaced rather than registered so the serializer can be registered multiple times for a database
+	create := db.Callback().Create()
+	update := db.Callback().Update()
+	query := db.Callback().Query()
+
+	err := create.After("gorm:before_create").Before("gorm:create").Replace(recordCreateCallback, s.prepare(true))
+	if err != nil {
+		return err
+	}
+
+	err = create.After("gorm:create").Before("gorm:commit_or_rollback_transaction").Replace(recordAssignCallback, s.assign)
+	if err != nil {
+		return err
+	}
+
+	err = update.After("gorm:before_update").Before("gorm:update").Replace(recordUpdateCallback, s.prepare(false))
+	if err != nil {
+		return err
+	}
+
+	return query.Before("gorm:query").Replace(recordQueryCallback, func(db *gorm.DB) { s.attach(db) })
+}
+
+// RemoveCallbacks removes the callbacks registered by RegisterCallbacks from the provided database.
+func (s *RecordSerializer) RemoveCallbacks(db *gorm.DB) error {
+	callbacks := db.Callback()
+
+	for _, err := range []error{
+		callbacks.Create().Remove(recordCreateCallback),
+		callbacks.Create().Remove(recordAssignCallback),
+		callbacks.Update().Remove(recordUpdateCallback),
+		callbacks.Query().Remove(recordQueryCallback),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordFields returns the fields of the schema encrypted using record keys.
+func recordFields(sch *schema.Schema) []*schema.Field {
+	if sch == nil {
+		return nil
+	}
+
+	fields := make([]*schema.Field, 0)
+	for _, field := range sch.Fields {
+		if field.DBName != "" && field.TagSettings["SERIALIZER"] == internal.AES_GCM_RECORD.Name {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// eachRow invokes the provided function for every addressable row of the statement.
+func eachRow(stmt *gorm.Statement, fn func(row reflect.Value) error) error {
+	rv := stmt.ReflectValue
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			row := reflect.Indirect(rv.Index(i))
+			if row.Kind() == reflect.Struct && row.CanAddr() {
+				if err := fn(row); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Struct:
+		if rv.CanAddr() {
+			return fn(rv)
+		}
+	}
+
+	return nil
+}
+
+// attach adds a recordScope to the context of the statement provided it contains fields encrypted using record keys.
+func (s *RecordSerializer) attach(db *gorm.DB) *recordScope {
+	stmt := db.Statement
+	if db.Error != nil || len(recordFields(stmt.Schema)) == 0 {
+		return nil
+	}
+
+	scope := &recordScope{
+		rows: make(map[uintptr]*database.RecordKey),
+		keys: make(map[string]cipher.AEAD),
+	}
+
+	stmt.Context = context.WithValue(stmt.Context, recordScopeKey{}, scope)
+
+	return scope
+}
+
+// writesRecordFields reports whether the statement writes a value to any of the fields encrypted using record keys,
+// following the same rules gorm uses to determine which columns are assigned.
+func writesRecordFields(stmt *gorm.Statement, create bool) bool {
+	selected, restricted := stmt.SelectAndOmitColumns(create, !create)
+
+	for _, field := range recordFields(stmt.Schema) {
+		include, ok := selected[field.DBName]
+		switch {
+		case ok && !include, !ok && restricted:
+			continue
+		case create, include:
+			return true
+		}
+
+		if values, ok := stmt.Dest.(map[string]interface{}); ok {
+			_, name := values[field.Name]
+			_, column := values[field.DBName]
+
+			if name || column {
+				return true
+			}
+
+			continue
+		}
+
+		dest := reflect.Indirect(reflect.ValueOf(stmt.Dest))
+		if dest.Kind() != reflect.Struct || dest.Type() != stmt.Schema.ModelType {
+			// values that cannot be inspected may be writing the field
+			return true
+		}
+
+		// gorm skips zero values when updating using a struct
+		if _, zero := field.ValueOf(stmt.Context, dest); !zero {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prepare loads or creates the key for each row being written. Keys are prepared before the statement executes since
+// values are serialized while the connection is in use. Statements that don't write any fields encrypted using record
+// keys are left alone.
+func (s *RecordSerializer) prepare(create bool) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Error != nil || !writesRecordFields(db.Statement, create) {
+			return
+		}
+
+		scope := s.attach(db)
+		if scope == nil {
+			return
+		}
+
+		stmt := db.Statement
+		if stmt.Schema.PrioritizedPrimaryField == nil {
+			_ = db.AddError(gorm.ErrPrimaryKeyRequired)
+			return
+		}
+
+		// use the statement's connection so keys are written within the same transaction as the record
+		txn := db.Session(&gorm.Session{NewDB: true})
+
+		err := eachRow(stmt, func(row reflect.Value) error {
+			recordID, zero := stmt.Schema.PrioritizedPrimaryField.ValueOf(stmt.Context, row)
+
+			var key *database.RecordKey
+			var err error
+
+			switch {
+			case !zero:
+				key, err = s.recordKey(txn, stmt.Schema.Table, fmt.Sprint(recordID))
+			case create:
+				// the primary key is assigned by the database, so it's recorded once the row has been created
+				key, err = s.newRecordKey(txn, stmt.Schema.Table, "")
+			default:
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			aead, err := newAEAD(key.DataKey)
+			if err != nil {
+				return err
+			}
+
+			scope.rows[row.Addr().Pointer()] = key
+			scope.keys[key.Fingerprint] = aead
+
+			return nil
+		})
+
+		if err != nil {
+			_ = db.AddError(err)
+		}
+	}
+}
+
+// assign records the primary key of rows whose keys were created before the primary key was known.
+func (s *RecordSerializer) assign(db *gorm.DB) {
+	stmt := db.Statement
+
+	scope, ok := stmt.Context.Value(recordScopeKey{}).(*recordScope)
+	if db.Error != nil || !ok {
+		return
+	}
+
+	txn := db.Session(&gorm.Session{NewDB: true})
+
+	err := eachRow(stmt, func(row reflect.Value) error {
+		key, ok := scope.rows[row.Addr().Pointer()]
+		if !ok || key.RecordID != "" {
+			return nil
+		}
+
+		recordID, zero := stmt.Schema.PrioritizedPrimaryField.ValueOf(stmt.Context, row)
+		if zero {
+			return fmt.Errorf("unable to determine primary key of record in %s", stmt.Schema.Table)
+		}
+
+		key.RecordID = fmt.Sprint(recordID)
+
+		return txn.Model(&database.RecordKey{}).
+			Where("fingerprint = ?", key.Fingerprint).
+			Update("record_id", key.RecordID).
+			Error
+	})
+
+	if err != nil {
+		_ = db.AddError(err)
+	}
+}
+
+// recordKey loads the most recent key for the record, creating one if none exist.
+func (s *RecordSerializer) recordKey(db *gorm.DB, table, recordID string) (*database.RecordKey, error) {
+	key := &database.RecordKey{}
+
+	err := db.
+		Where("table_name = ? AND record_id = ?", table, recordID).
+		Order("created_at desc").
+		Limit(1).
+		Find(key).
+		Error
+
+	switch {
+	case err != nil:
+		return nil, err
+	case key.Fingerprint == "":
+		return s.newRecordKey(db, table, recordID)
+	}
+
+	key.DataKey, err = s.provider.Unwrap(db.Statement.Context, key.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (s *RecordSerializer) newRecordKey(db *gorm.DB, table, recordID string) (*database.RecordKey, error) {
+	dataKey, err := internal.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hmac.New(sha256.New, s.hmacKey)
+	hash.Write(dataKey)
+
+	wrapped, err := s.provider.Wrap(db.Statement.Context, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &database.RecordKey{
+		Fingerprint: base64.RawURLEncoding.EncodeToString(hash.Sum(nil)),
+		Table:       table,
+		RecordID:    recordID,
+		DataKey:     wrapped,
+	}
+
+	err = db.Create(key).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// only the wrapped data key is stored, keep the plaintext key in memory
+	key.DataKey = dataKey
+
+	return key, nil
+}
+
+// Get loads and unwraps the record key with the provided fingerprint, returning the AEAD constructed from it. Keys that
+// no longer exist have been shredded, causing ErrKeyDestroyed to be returned.
+func (s *RecordSerializer) Get(ctx context.Context, fingerprint string) (cipher.AEAD, error) {
+	scope, ok := ctx.Value(recordScopeKey{}).(*recordScope)
+	if ok {
+		if aead, ok := scope.keys[fingerprint]; ok {
+			s.usage.Hits.Add(1)
+			return aead, nil
+		}
+	}
+
+	s.usage.Misses.Add(1)
+
+	key := &database.RecordKey{}
+
+	err := s.db.WithContext(ctx).First(key, "fingerprint = ?", fingerprint).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, fmt.Errorf("%w: %s", database.ErrKeyDestroyed, fingerprint)
+	case err != nil:
+		return nil, err
+	}
+
+	dataKey, err := s.provider.Unwrap(ctx, key.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		scope.keys[fingerprint] = aead
+	}
+
+	return aead, nil
+}
+
+// Stats returns a snapshot of how the serializer has been used.
+func (s *RecordSerializer) Stats() Stats {
+	return s.usage.Stats()
+}
+
+// Close prevents the serializer from being used to encrypt or decrypt any more values.
+func (s *RecordSerializer) Close() error {
+	s.usage.Closed.Store(true)
+	return nil
+}
+
+// Scan converts on-disk, ciphertext into a plaintext in-memory field value.
+func (s *RecordSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	if s.usage.Closed.Load() {
+		return ErrClosed
+	}
+
+	ciphertext, ok := dbValue.([]byte)
+	if !ok {
+		return fmt.Errorf("encryption only works on []byte ciphertext")
+	}
+
+	algorithm, flags, fingerprint, ciphertext := database.ParseFlaggedField(ciphertext)
+
+	err := requireAAD(field, fingerprint, flags)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fingerprint == "":
+		// field does not appear encrypted, treat data as plaintext
+		field.ReflectValueOf(ctx, dst).SetBytes(ciphertext)
+
+		return nil
+	case algorithm != internal.AES_GCM_RECORD.ID && s.fallback != nil:
+		return s.fallback.Scan(ctx, field, dst, dbValue)
+	case algorithm != internal.AES_GCM_RECORD.ID:
+		return internal.UnexpectedAlgorithm(internal.AES_GCM_RECORD, algorithm)
+	}
+
+	aead, err := s.Get(ctx, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	aad, err := associatedData(ctx, field, dst, flags)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := open(aead, ciphertext, aad)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err = s.compression.decompress(flags, plaintext)
+	if err != nil {
+		return err
+	}
+
+	s.usage.Decrypted.Add(1)
+
+	return setPlaintext(ctx, s.unmarshaler, field, dst, plaintext)
+}
+
+// Value converts a plaintext, in-memory field value into an encrypted field value intended for storage in SQL systems.
+func (s *RecordSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	if s.usage.Closed.Load() {
+		return nil, ErrClosed
+	}
+
+	scope, ok := ctx.Value(recordScopeKey{}).(*recordScope)
+	if !ok {
+		return nil, fmt.Errorf("%s requires callbacks to be registered", internal.AES_GCM_RECORD.Name)
+	}
+
+	var key *database.RecordKey
+	if dst.CanAddr() {
+		key = scope.rows[dst.Addr().Pointer()]
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("%s requires the primary key of the record to be known", internal.AES_GCM_RECORD.Name)
+	}
+
+	plaintext, err := plaintextOf(s.marshaler, fieldValue)
+	if err != nil {
+		return nil, err
+	}
+
+	flags, plaintext, err := s.compression.compress(field, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	aadFlags, err := aadFlags(ctx, field, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	flags |= aadFlags
+
+	aad, err := associatedData(ctx, field, dst, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(scope.keys[key.Fingerprint], plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	s.usage.Encrypted.Add(1)
+
+	return database.FormatFlaggedField(internal.AES_GCM_RECORD.ID, flags, key.Fingerprint, ciphertext), nil
+}
@@ -5,18 +5,22 @@ package aesgcm
 
 import (
 	"context"
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
+	"golang.org/x/sync/singleflight"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/schema"
 
 	"go.pitz.tech/gorm/encryption/database"
@@ -25,66 +29,155 @@ import (
 
 func New(
 	db *gorm.DB,
-	hmac []byte,
+	provider database.KeyProvider,
 	cacheSize int,
 	cacheDuration time.Duration,
+	negativeCacheDuration time.Duration,
+	coalesce bool,
 	rotationDuration time.Duration,
+	compression Compression,
 	marshaler func(any) ([]byte, error),
 	unmarshaler func([]byte, any) error,
+	tenantResolver func(context.Context) string,
 ) (*Serializer, error) {
-	hmacKey := sha256.Sum256(hmac)
+	err := compression.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	shared := tenantResolver == nil
+	if shared {
+		tenantResolver = func(context.Context) string { return "" }
+	}
 
 	serializer := &Serializer{
 		db:               db,
-		hmacKey:          hmacKey[:],
-		current:          make(chan *database.Key, 1),
-		cache:            expirable.NewLRU[string, *database.Key](cacheSize, nil, cacheDuration),
+		provider:         provider,
+		hmacKey:          fingerprintKey(provider),
+		tenant:           tenantResolver,
+		current:          &activeKeys{},
+		usage:            &usage{},
+		cache:            expirable.NewLRU[string, *dataKey](cacheSize, nil, cacheDuration),
+		cacheDuration:    cacheDuration,
 		rotationDuration: rotationDuration,
-		rotate:           time.NewTicker(rotationDuration),
+		suite:            suites[internal.AES_GCM.ID],
+		compression:      compression,
 		marshaler:        marshaler,
 		unmarshaler:      unmarshaler,
 	}
 
-	{
-		key := &database.Key{}
+	if negativeCacheDuration > 0 {
+		serializer.missing = expirable.NewLRU[string, error](negativeCacheSize, nil, negativeCacheDuration)
+	}
 
-		err := db.
-			Where("created_at > ?", time.Now().Add(-1*rotationDuration)).
-			Order("created_at desc").
-			Limit(1).
-			Find(key).
-			Error
+	if coalesce {
+		serializer.lookups = &singleflight.Group{}
+	}
 
-		if err != nil || key.Fingerprint == "" {
-			key, err = serializer.newKey()
-			if err != nil {
-				return nil, err
-			}
+	if shared {
+		// eagerly load the shared key to surface configuration issues early on
+		_, err = serializer.currentKey(context.Background())
+		if err != nil {
+			return nil, err
 		}
-
-		serializer.current <- key
 	}
 
 	return serializer, nil
 }
 
 // Serializer provides a Gorm Serializer capable of encrypting and decrypting database fields using an AES+GCM
-// cipher. The same encryption key can be used for multiple values in an attempt to optimize performance.
+// cipher. The same encryption key can be used for multiple values in an attempt to optimize performance. When a tenant
+// resolver is configured, each tenant is given their own set of keys. Serializers for other algorithms sharing the same
+// keys can be obtained using WithAlgorithm. Fields tagged using the aad setting bind their values to the table, column,
+// and row they're stored in, preventing ciphertexts from being copied between them. Plaintexts are compressed before
+// they're encrypted when configured using Compression or the compress tag setting.
 type Serializer struct {
-	db *gorm.DB
+	db       *gorm.DB
+	provider database.KeyProvider
+
+	hmacKey       []byte
+	tenant        func(context.Context) string
+	current       *activeKeys
+	usage         *usage
+	cache         *expirable.LRU[string, *dataKey]
+	cacheDuration time.Duration
 
-	hmacKey []byte
-	current chan *database.Key
-	cache   *expirable.LRU[string, *database.Key]
+	// missing caches the errors of lookups for keys that could not be found. lookups coalesces concurrent lookups of
+	// the same key. Both are nil when disabled.
+	missing *expirable.LRU[string, error]
+	lookups *singleflight.Group
 
 	rotationDuration time.Duration
-	rotate           *time.Ticker
+
+	suite       suite
+	compression Compression
+
+	// fallback reads values written using algorithms that don't use data keys, when configured.
+	fallback schema.SerializerInterface
 
 	marshaler   func(any) ([]byte, error)
 	unmarshaler func([]byte, any) error
 }
 
-func (s *Serializer) newKey() (*database.Key, error) {
+// negativeCacheSize bounds how many missing keys are remembered, preventing unknown fingerprints from growing the
+// cache without limit.
+const negativeCacheSize = 1024
+
+// WithAlgorithm returns a Serializer that encrypts values using the named algorithm. The returned serializer shares
+// its data keys, caches, and usage with this one.
+func (s *Serializer) WithAlgorithm(name string) (*Serializer, error) {
+	algorithm, err := database.AlgorithmByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	suite, ok := suites[algorithm.ID]
+	if !ok {
+		return nil, fmt.Errorf("algorithm %s does not support data keys", name)
+	}
+
+	variant := *s
+	variant.suite = suite
+
+	return &variant, nil
+}
+
+// WithFallback returns a Serializer that reads values written using algorithms that don't use data keys using the
+// fallback, rather than returning an error. The returned serializer shares its data keys, caches, and usage with this
+// one.
+func (s *Serializer) WithFallback(fallback schema.SerializerInterface) *Serializer {
+	variant := *s
+	variant.fallback = fallback
+
+	return &variant
+}
+
+// AlgorithmID returns the ID of the algorithm used to encrypt new values.
+func (s *Serializer) AlgorithmID() byte {
+	return s.suite.algorithm.ID
+}
+
+// fingerprintKey returns the secret key used to fingerprint new data keys. Providers that can't supply one fall back to
+// a key derived from their KeyID.
+func fingerprintKey(provider database.KeyProvider) []byte {
+	if provider, ok := provider.(database.FingerprintKeyProvider); ok {
+		if key := provider.FingerprintKey(); key != nil {
+			return key
+		}
+	}
+
+	hmacKey := sha256.Sum256([]byte(provider.KeyID()))
+
+	return hmacKey[:]
+}
+
+// errRotationClaimed is returned when another process has already replaced the previous key.
+var errRotationClaimed = errors.New("key rotation claimed by another process")
+
+// newKey creates a new key for the tenant, replacing the previous key. The rotation is recorded within the same
+// transaction as the key. Since only one rotation can be recorded for the previous key, errRotationClaimed is returned
+// when another process has already replaced it.
+func (s *Serializer) newKey(ctx context.Context, tenant, previous string) (*database.Key, error) {
 	dataKey, err := internal.GenerateKey()
 	if err != nil {
 		return nil, err
@@ -93,153 +186,644 @@ func (s *Serializer) newKey() (*database.Key, error) {
 	hash := hmac.New(sha256.New, s.hmacKey)
 	hash.Write(dataKey)
 
+	wrapped, err := s.provider.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
 	key := &database.Key{
 		Fingerprint: base64.RawURLEncoding.EncodeToString(hash.Sum(nil)),
-		DataKey:     dataKey[:],
+		Tenant:      tenant,
+		Status:      database.KeyActive,
+		DataKey:     wrapped,
 	}
 
-	err = s.db.Create(key).Error
+	err = s.db.WithContext(ctx).Transaction(func(txn *gorm.DB) error {
+		err := txn.Create(key).Error
+		if err != nil {
+			return err
+		}
+
+		result := txn.Clauses(clause.OnConflict{DoNothing: true}).Create(&database.KeyRotation{
+			Tenant:      tenant,
+			Previous:    previous,
+			Fingerprint: key.Fingerprint,
+		})
+
+		switch {
+		case result.Error != nil:
+			return result.Error
+		case result.RowsAffected == 0:
+			return errRotationClaimed
+		}
+
+		return nil
+	})
+
 	if err != nil {
 		return nil, err
 	}
 
+	// only the wrapped data key is stored, keep the plaintext key in memory
+	key.DataKey = dataKey[:]
+
 	return key, err
 }
 
-func (s *Serializer) currentKey() *database.Key {
-	select {
-	case <-s.rotate.C:
-		current := <-s.current
+// usable returns true when the key can be used to encrypt new values.
+func (s *Serializer) usable(key *database.Key) bool {
+	return key.Status == database.KeyActive &&
+		!key.DeletedAt.Valid &&
+		len(key.DataKey) > 0 &&
+		time.Since(key.CreatedAt) <= s.rotationDuration
+}
+
+// latestKey returns the key that should be used to encrypt new values for the tenant. Starting from the newest key, any
+// recorded rotations are followed to the most recent replacement. When that key can no longer be used, it's rotated.
+// Since each key can only be replaced once, every process converges on the same key. The current key is returned as is
+// when it's still the latest, avoiding the need to unwrap it again.
+func (s *Serializer) latestKey(ctx context.Context, tenant string, current *database.Key) (*database.Key, error) {
+	db := s.db.WithContext(ctx)
+	key := &database.Key{}
 
-		next, err := s.newKey()
+	// soft-deleted keys are considered so that rotations recorded after them are followed
+	err := db.Unscoped().Where("tenant = ?", tenant).Order("created_at desc").Limit(1).Find(key).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		rotation := &database.KeyRotation{}
+
+		err = db.Where("tenant = ? AND previous = ?", tenant, key.Fingerprint).Limit(1).Find(rotation).Error
 		if err != nil {
-			return current
+			return nil, err
+		}
+
+		if rotation.Fingerprint != "" {
+			next := &database.Key{}
+
+			err = db.Unscoped().Where("fingerprint = ?", rotation.Fingerprint).Limit(1).Find(next).Error
+			if err != nil {
+				return nil, err
+			}
+
+			// keys that have been deleted can no longer be used, but rotations can still be recorded after them
+			next.Fingerprint = rotation.Fingerprint
+			key = next
+
+			continue
+		}
+
+		if s.usable(key) {
+			if current != nil && current.Fingerprint == key.Fingerprint {
+				return current, nil
+			}
+
+			key.DataKey, err = s.provider.Unwrap(ctx, key.DataKey)
+			if err != nil {
+				return nil, err
+			}
+
+			return key, nil
 		}
 
-		s.rotate.Reset(s.rotationDuration)
+		next, err := s.newKey(ctx, tenant, key.Fingerprint)
+		switch {
+		case errors.Is(err, errRotationClaimed):
+			// another process rotated the key first, follow their rotation
+			continue
+		case err != nil && key.Status != database.KeyActive && current != nil && current.Fingerprint == key.Fingerprint:
+			// the current key has been moved out of the active state, so it can no longer be used for new values
+			return nil, fmt.Errorf("%w: %s is %s: %v", database.ErrInvalidTransition, key.Fingerprint, key.Status, err)
+		case err != nil:
+			return nil, err
+		}
 
-		return next
-	case current := <-s.current:
-		return current
+		return next, nil
 	}
 }
 
-// Get implements loading logic that pulls encryption keys from the database and caches them in memory to improve
-// performance of decrypting field values.
-func (s *Serializer) Get(fingerprint string) (*database.Key, error) {
-	dataKey, ok := s.cache.Get(fingerprint)
+// activeKeys tracks the key currently used to encrypt new values for each tenant.
+type activeKeys struct {
+	tenants sync.Map
+
+	// mu guards starting background refreshes against waiting for them to complete once closed.
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+
+	// evicted is when idle tenants were last evicted, in nanoseconds since the epoch.
+	evicted atomic.Int64
+}
+
+// evictIdle removes the slots of tenants whose key hasn't been verified within the idle duration. Those keys need to be
+// loaded from the database before they're used again anyway, so evicting them keeps tenants that are no longer active
+// from being held in memory forever. Tenants are checked at most once per idle duration.
+func (a *activeKeys) evictIdle(idle time.Duration) {
+	now := time.Now()
+
+	last := a.evicted.Load()
+	if idle <= 0 || now.Sub(time.Unix(0, last)) < idle || !a.evicted.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	a.tenants.Range(func(tenant, value any) bool {
+		slot := value.(*tenantKey)
+
+		// tenants whose key is being loaded or rotated are in use
+		if !slot.mu.TryLock() {
+			return true
+		}
+
+		defer slot.mu.Unlock()
+
+		current := slot.current.Load()
+		if !slot.refreshing.Load() && (current == nil || now.Sub(current.verified) > idle) {
+			a.tenants.Delete(tenant)
+		}
+
+		return true
+	})
+}
+
+// start reserves a background refresh, returning false once the keys have been closed.
+func (a *activeKeys) start() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return false
+	}
+
+	a.wg.Add(1)
+
+	return true
+}
+
+// close prevents any more background refreshes from starting, waits for the running ones to complete, and then
+// discards every active key.
+func (a *activeKeys) close() {
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+
+	a.wg.Wait()
+
+	a.tenants.Range(func(tenant, _ any) bool {
+		a.tenants.Delete(tenant)
+		return true
+	})
+}
+
+// tenant returns the slot holding the active key for the tenant.
+func (a *activeKeys) tenant(tenant string) *tenantKey {
+	slot, ok := a.tenants.Load(tenant)
 	if !ok {
-		dataKey = &database.Key{}
+		slot, _ = a.tenants.LoadOrStore(tenant, &tenantKey{})
+	}
 
-		err := s.db.First(dataKey, "fingerprint = ?", fingerprint).Error
-		if err != nil {
+	return slot.(*tenantKey)
+}
+
+// tenantKey holds the active key for a single tenant. The key is swapped atomically, allowing values to be encrypted
+// without waiting on the database while the key is refreshed in the background. The mutex is only held while loading
+// or rotating the key.
+type tenantKey struct {
+	mu         sync.Mutex
+	current    atomic.Pointer[activeKey]
+	refreshing atomic.Bool
+}
+
+// dataKey pairs an unwrapped data key with the AEADs constructed from it, so each AEAD is only constructed once per
+// key.
+type dataKey struct {
+	*database.Key
+
+	// aeads contains the AEAD constructed for each algorithm that has used the key, indexed by algorithm ID.
+	aeads sync.Map
+}
+
+// newDataKey wraps the key, constructing the AEAD for the provided suite up front to validate the key.
+func newDataKey(key *database.Key, suite suite) (*dataKey, error) {
+	k := &dataKey{Key: key}
+
+	_, err := k.aead(suite)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// aead returns the AEAD for the provided suite, constructing it the first time it's needed.
+func (k *dataKey) aead(suite suite) (cipher.AEAD, error) {
+	if aead, ok := k.aeads.Load(suite.algorithm.ID); ok {
+		return aead.(cipher.AEAD), nil
+	}
+
+	aead, err := suite.newAEAD(k.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, _ := k.aeads.LoadOrStore(suite.algorithm.ID, aead)
+
+	return stored.(cipher.AEAD), nil
+}
+
+// activeKey tracks the key currently used to encrypt new values along with the last time it was verified to still be
+// the latest key. Active keys are never modified once stored, new ones are swapped in instead.
+type activeKey struct {
+	*dataKey
+	verified time.Time
+}
+
+// currentKey returns the active key for the tenant associated with the context. Once half of the cache duration has
+// elapsed, the key is refreshed in the background to pick up rotations made by other processes, changes to its status,
+// or to rotate it when the rotation period has elapsed. Writes only wait on the database when loading the first key for
+// a tenant or when the key could not be refreshed within the cache duration. Refreshes made on behalf of a writer honor
+// the deadline of its context, while background refreshes are not tied to any single writer. The keys of tenants that
+// haven't written any values within the cache duration are evicted. ErrClosed is returned once the serializer has been
+// closed.
+func (s *Serializer) currentKey(ctx context.Context) (*activeKey, error) {
+	if s.usage.Closed.Load() {
+		return nil, ErrClosed
+	}
+
+	s.current.evictIdle(s.cacheDuration)
+
+	tenant := s.tenant(ctx)
+	slot := s.current.tenant(tenant)
+
+	current := slot.current.Load()
+	switch {
+	case current == nil || time.Since(current.verified) > s.cacheDuration:
+		return s.refresh(ctx, tenant, slot, current)
+
+	case time.Since(current.verified) > s.cacheDuration/2 && slot.refreshing.CompareAndSwap(false, true):
+		if !s.current.start() {
+			// the serializer is closing, the key will not be refreshed again
+			slot.refreshing.Store(false)
+			break
+		}
+
+		go func() {
+			defer s.current.wg.Done()
+			defer slot.refreshing.Store(false)
+
+			// errors are surfaced to writers once the key can no longer be used
+			_, _ = s.refresh(context.Background(), tenant, slot, current)
+		}()
+	}
+
+	return current, nil
+}
+
+// refresh checks the database for the latest key for the tenant, replacing the observed key. When another goroutine
+// has already replaced the observed key, the replacement is returned.
+func (s *Serializer) refresh(ctx context.Context, tenant string, slot *tenantKey, observed *activeKey) (*activeKey, error) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	current := slot.current.Load()
+	if current != nil && current != observed {
+		return current, nil
+	}
+
+	var previous *database.Key
+	if current != nil {
+		previous = current.Key
+	}
+
+	key, err := s.latestKey(ctx, tenant, previous)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// the writer gave up waiting, leave the key to be checked by the next writer
+		return nil, err
+	case err != nil && (current == nil || errors.Is(err, database.ErrInvalidTransition)):
+		slot.current.Store(nil)
+		return nil, err
+	case err != nil:
+		// transient errors should not prevent writes, the key will be checked again later
+		key = current.Key
+	}
+
+	next := &activeKey{verified: time.Now()}
+
+	if current != nil && current.Key == key {
+		next.dataKey = current.dataKey
+	} else if next.dataKey, err = newDataKey(key, s.suite); err != nil {
+		slot.current.Store(nil)
+		return nil, err
+	}
+
+	slot.current.Store(next)
+
+	return next, nil
+}
+
+// CurrentFingerprint returns the fingerprint of the key currently used to encrypt new values for the tenant associated
+// with the context.
+func (s *Serializer) CurrentFingerprint(ctx context.Context) (string, error) {
+	key, err := s.currentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return key.Fingerprint, nil
+}
+
+// Rotate replaces the current key for the tenant associated with the context with a new key, regardless of how long
+// the current key has been in use. When another process rotates the key at the same time, their key is used instead.
+func (s *Serializer) Rotate(ctx context.Context) error {
+	if s.usage.Closed.Load() {
+		return ErrClosed
+	}
+
+	tenant := s.tenant(ctx)
+	slot := s.current.tenant(tenant)
+
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	var previous *database.Key
+	if current := slot.current.Load(); current != nil {
+		previous = current.Key
+	}
+
+	latest, err := s.latestKey(ctx, tenant, previous)
+	if err != nil {
+		return err
+	}
+
+	key, err := s.newKey(ctx, tenant, latest.Fingerprint)
+	if errors.Is(err, errRotationClaimed) {
+		key, err = s.latestKey(ctx, tenant, nil)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	next, err := newDataKey(key, s.suite)
+	if err != nil {
+		return err
+	}
+
+	slot.current.Store(&activeKey{dataKey: next, verified: time.Now()})
+
+	return nil
+}
+
+// Evict drops the key with the provided fingerprint from memory, including from the keys used to encrypt new values.
+// Tenants whose current key is evicted load the latest key from the database the next time they encrypt a value.
+func (s *Serializer) Evict(fingerprint string) {
+	s.current.tenants.Range(func(_, value any) bool {
+		slot := value.(*tenantKey)
+
+		slot.mu.Lock()
+		defer slot.mu.Unlock()
+
+		if current := slot.current.Load(); current != nil && current.Fingerprint == fingerprint {
+			slot.current.Store(nil)
+		}
+
+		return true
+	})
+
+	for _, cacheKey := range s.cache.Keys() {
+		if strings.HasPrefix(cacheKey, fingerprint+",") {
+			s.cache.Remove(cacheKey)
+		}
+	}
+}
+
+// Stats returns a snapshot of how the serializer has been used.
+func (s *Serializer) Stats() Stats {
+	stats := s.usage.Stats()
+	stats.CachedKeys = int64(s.cache.Len())
+
+	s.current.tenants.Range(func(_, slot any) bool {
+		if slot.(*tenantKey).current.Load() != nil {
+			stats.ActiveKeys++
+		}
+
+		return true
+	})
+
+	return stats
+}
+
+// Close waits for any background refreshes to complete and discards any keys held in memory. Once closed, the
+// serializer can no longer be used to encrypt or decrypt values.
+func (s *Serializer) Close() error {
+	s.usage.Closed.Store(true)
+	s.current.close()
+
+	s.cache.Purge()
+
+	if s.missing != nil {
+		s.missing.Purge()
+	}
+
+	return nil
+}
+
+// get implements loading logic that pulls encryption keys from the database and caches them in memory to improve
+// performance of decrypting field values. Keys are scoped to the tenant associated with the context.
+func (s *Serializer) get(ctx context.Context, fingerprint string) (*dataKey, error) {
+	if scope, ok := ctx.Value(prefetchScopeKey{}).(prefetchScope); ok {
+		if prefetched, ok := scope[fingerprint]; ok {
+			s.usage.Hits.Add(1)
+			return prefetched, nil
+		}
+	}
+
+	tenant := s.tenant(ctx)
+	cacheKey := fingerprint + "," + tenant
+
+	cached, ok := s.cache.Get(cacheKey)
+	if ok {
+		s.usage.Hits.Add(1)
+		return cached, nil
+	}
+
+	if s.missing != nil {
+		if err, ok := s.missing.Get(cacheKey); ok {
 			return nil, err
 		}
+	}
+
+	s.usage.Misses.Add(1)
+
+	if s.lookups == nil {
+		return s.load(ctx, fingerprint, tenant)
+	}
+
+	// concurrent lookups of the same key share a single query, made using the context of the first caller
+	loaded, err, shared := s.lookups.Do(cacheKey, func() (any, error) {
+		return s.load(ctx, fingerprint, tenant)
+	})
 
-		s.cache.Add(fingerprint, dataKey)
+	if err != nil && shared && ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		// the caller making the lookup gave up, but this one hasn't
+		return s.load(ctx, fingerprint, tenant)
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
-	return dataKey, nil
+	return loaded.(*dataKey), nil
+}
+
+// load reads a key from the database and adds it to the cache. Keys belonging to another tenant return a
+// *database.TenantMismatchError. Keys that could not be found, or that belong to another tenant, are added to the
+// negative cache when enabled.
+func (s *Serializer) load(ctx context.Context, fingerprint, tenant string) (*dataKey, error) {
+	cacheKey := fingerprint + "," + tenant
+	key := &database.Key{}
+
+	// soft-deleted keys may still be protecting data
+	err := s.db.WithContext(ctx).Unscoped().First(key, "fingerprint = ?", fingerprint).Error
+	if err == nil && key.Tenant != tenant {
+		err = &database.TenantMismatchError{Fingerprint: fingerprint, Tenant: tenant}
+	}
+
+	if err != nil {
+		var mismatch *database.TenantMismatchError
+		if s.missing != nil && (errors.Is(err, gorm.ErrRecordNotFound) || errors.As(err, &mismatch)) {
+			s.missing.Add(cacheKey, err)
+		}
+
+		return nil, err
+	}
+
+	switch key.Status {
+	case database.KeyDestroyed:
+		return nil, fmt.Errorf("%w: %s", database.ErrKeyDestroyed, fingerprint)
+	case database.KeyRetired:
+		return nil, fmt.Errorf("%w: %s", database.ErrKeyRetired, fingerprint)
+	}
+
+	key.DataKey, err = s.provider.Unwrap(ctx, key.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, err := newDataKey(key, s.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.Add(cacheKey, cached)
+
+	return cached, nil
 }
 
 // Scan converts on-disk, ciphertext into a plaintext in-memory field value.
 func (s *Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	if s.usage.Closed.Load() {
+		return ErrClosed
+	}
+
 	ciphertext, ok := dbValue.([]byte)
 	if !ok {
 		return fmt.Errorf("encryption only works on []byte ciphertext")
 	}
 
-	algorithm, fingerprint, ciphertext := database.ParseField(ciphertext)
+	algorithm, flags, fingerprint, ciphertext := database.ParseFlaggedField(ciphertext)
+
+	err := requireAAD(field, fingerprint, flags)
+	if err != nil {
+		return err
+	}
+
+	// values encrypted by any algorithm sharing the data keys can be read, allowing columns to move between them
+	suite, ok := suites[algorithm]
+
 	switch {
 	case fingerprint == "":
 		// field does not appear encrypted, treat data as plaintext
 		field.ReflectValueOf(ctx, dst).SetBytes(ciphertext)
 
 		return nil
-	case algorithm != internal.AES_GCM.ID:
-		return fmt.Errorf("expected %s but got: %s", internal.AES_GCM.Name, internal.AlgorithmsByID[algorithm].Name)
+	case !ok && s.fallback != nil:
+		return s.fallback.Scan(ctx, field, dst, dbValue)
+	case !ok:
+		return internal.UnexpectedAlgorithm(s.suite.algorithm, algorithm)
 	}
 
 	// get key by fingerprint
 
-	key, err := s.Get(fingerprint)
+	key, err := s.get(ctx, fingerprint)
 	if err != nil {
 		return err
 	}
 
 	// decrypt
 
-	block, err := aes.NewCipher(key.DataKey)
+	// values written without associated data continue to open, unless the field requires them to be bound
+	aad, err := associatedData(ctx, field, dst, flags)
 	if err != nil {
 		return err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	plaintext, err := suite.open(key, ciphertext, aad)
 	if err != nil {
 		return err
 	}
 
-	nonceSize := gcm.NonceSize()
-
-	plaintext, err := gcm.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+	plaintext, err = s.compression.decompress(flags, plaintext)
 	if err != nil {
 		return err
 	}
 
-	v := field.ReflectValueOf(ctx, dst)
-
-	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
-		v.SetBytes(plaintext)
-	} else {
-		val := reflect.New(field.FieldType)
-		err = s.unmarshaler(plaintext, val.Interface())
-		if err != nil {
-			return err
-		}
-
-		v.Set(val.Elem())
-	}
+	s.usage.Decrypted.Add(1)
 
-	return nil
+	return setPlaintext(ctx, s.unmarshaler, field, dst, plaintext)
 }
 
 // Value converts a plaintext, in-memory field value into an encrypted field value intended for storage in SQL systems.
 func (s *Serializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
-	var plaintext []byte
-	var err error
-
-	switch v := fieldValue.(type) {
-	case []byte:
-		plaintext = v
-	default:
-		plaintext, err = s.marshaler(v)
-		if err != nil {
-			return nil, err
-		}
+	if s.usage.Closed.Load() {
+		return nil, ErrClosed
 	}
 
-	key := s.currentKey()
-	defer func() { s.current <- key }()
+	plaintext, err := plaintextOf(s.marshaler, fieldValue)
+	if err != nil {
+		return nil, err
+	}
 
-	// encrypt
+	key, err := s.currentKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	flags, plaintext, err := s.compression.compress(field, plaintext)
+	if err != nil {
+		return nil, err
+	}
 
-	block, err := aes.NewCipher(key.DataKey)
+	aadFlags, err := aadFlags(ctx, field, dst)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	flags |= aadFlags
+
+	aad, err := associatedData(ctx, field, dst, flags)
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = rand.Read(nonce)
+	ciphertext, err := s.suite.seal(key.dataKey, plaintext, aad)
 	if err != nil {
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	s.usage.Encrypted.Add(1)
 
-	return database.FormatField(internal.AES_GCM.ID, key.Fingerprint, ciphertext), nil
+	return database.FormatFlaggedField(s.suite.algorithm.ID, flags, key.Fingerprint, ciphertext), nil
 }
@@ -0,0 +1,17 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package aesgcm
+
+import (
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+// ErrClosed is returned when a serializer is used after it has been closed.
+var ErrClosed = internal.ErrClosed
+
+// Stats reports how a serializer has been used.
+type Stats = internal.Stats
+
+// usage tracks how a serializer is used.
+type usage = internal.Usage
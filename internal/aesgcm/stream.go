@@ -0,0 +1,405 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package aesgcm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+const (
+	// streamChunkSize is the amount of plaintext encrypted in each chunk of a stream. Only a single chunk needs to be
+	// held in memory while encrypting or decrypting, no matter how large the value is.
+	streamChunkSize = 64 * 1024
+
+	// streamSaltSize is the size of the random salt used to derive the key for each stream.
+	streamSaltSize = 32
+
+	// streamNonceSize is the size of the nonce used for each chunk: an 11 byte big endian counter followed by a byte
+	// flagging the final chunk.
+	streamNonceSize = 12
+)
+
+// streamSuite encrypts values in chunks using the STREAM construction, where each chunk is sealed using AES+GCM with
+// a nonce derived from its position in the stream and whether it's the final chunk. Chunks cannot be reordered,
+// dropped, or truncated without failing to open. Each stream is encrypted using a key derived from the data key and a
+// random salt, so the nonces can be derived deterministically without ever repeating for the same key.
+var streamSuite = suite{internal.AES_GCM_STREAM, newAEAD, true}
+
+// newStreamAEAD derives the AEAD used to encrypt the chunks of a stream from the data key and the salt of the stream.
+func newStreamAEAD(key, salt []byte) (cipher.AEAD, error) {
+	derived := make([]byte, 32)
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(internal.AES_GCM_STREAM.Name)), derived)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEAD(derived)
+}
+
+// streamNonce returns the nonce used to seal the chunk at the provided position of a stream.
+func streamNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, streamNonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+
+	if final {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// sealStream encrypts the plaintext as a single stream.
+func sealStream(key, plaintext, aad []byte) ([]byte, error) {
+	chunks := len(plaintext)/streamChunkSize + 1
+	buffer := bytes.NewBuffer(make([]byte, 0, streamSaltSize+len(plaintext)+chunks*16))
+
+	writer, err := newStreamWriter(buffer, key, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = writer.Write(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// openStream decrypts a ciphertext produced by sealStream.
+func openStream(key, ciphertext, aad []byte) ([]byte, error) {
+	reader, err := newStreamReader(bytes.NewReader(ciphertext), key, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(reader)
+}
+
+// streamWriter encrypts everything written to it, writing the sealed chunks to the underlying writer. A full chunk is
+// held back until more data is written, since the final chunk must be flagged as such.
+type streamWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	buffer  []byte
+	counter uint64
+	closed  bool
+}
+
+// newStreamWriter writes the salt of a new stream to the writer, returning a writer for its chunks.
+func newStreamWriter(dst io.Writer, key, aad []byte) (*streamWriter, error) {
+	salt := make([]byte, streamSaltSize)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newStreamAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dst.Write(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		dst:    dst,
+		aead:   aead,
+		aad:    aad,
+		buffer: make([]byte, 0, streamChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// Write encrypts the data, writing each chunk once it's full and more data follows it.
+func (w *streamWriter) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, fmt.Errorf("write to closed stream")
+	}
+
+	for len(p) > 0 {
+		if len(w.buffer) == streamChunkSize {
+			err = w.flush(false)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		written := copy(w.buffer[len(w.buffer):streamChunkSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+written]
+
+		p = p[written:]
+		n += written
+	}
+
+	return n, nil
+}
+
+// Close writes the final chunk of the stream. Streams that aren't closed cannot be decrypted.
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	return w.flush(true)
+}
+
+func (w *streamWriter) flush(final bool) error {
+	chunk := w.aead.Seal(w.buffer[:0], streamNonce(w.counter, final), w.buffer, w.aad)
+
+	_, err := w.dst.Write(chunk)
+	if err != nil {
+		return err
+	}
+
+	w.buffer = w.buffer[:0]
+	w.counter++
+
+	return nil
+}
+
+// errTruncatedStream is returned when a stream ends before its final chunk.
+var errTruncatedStream = errors.New("encrypted stream is truncated")
+
+// streamReader decrypts a stream one chunk at a time.
+type streamReader struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	aad       []byte
+	chunk     []byte
+	plaintext []byte
+	counter   uint64
+	done      bool
+
+	// next holds the first byte of the following chunk, which is read ahead to know whether a chunk is the final one.
+	next []byte
+}
+
+// newStreamReader reads the salt of a stream from the reader, returning a reader for its decrypted contents.
+func newStreamReader(src io.Reader, key, aad []byte) (*streamReader, error) {
+	salt := make([]byte, streamSaltSize)
+
+	_, err := io.ReadFull(src, salt)
+	if err != nil {
+		return nil, errTruncatedStream
+	}
+
+	aead, err := newStreamAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		src:   src,
+		aead:  aead,
+		aad:   aad,
+		chunk: make([]byte, streamChunkSize+aead.Overhead()+1),
+	}, nil
+}
+
+// Read decrypts the next chunk of the stream once the previous one has been consumed. Reaching the end of the
+// underlying reader before the final chunk returns an error.
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		err := r.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+
+	return n, nil
+}
+
+func (r *streamReader) readChunk() error {
+	chunk := r.chunk[:copy(r.chunk, r.next)]
+
+	n, err := io.ReadFull(r.src, r.chunk[len(chunk):])
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// a short read means this is the final chunk
+	case err != nil:
+		return err
+	}
+
+	chunk = r.chunk[:len(chunk)+n]
+	final := len(chunk) < len(r.chunk)
+
+	if final {
+		r.next = nil
+	} else {
+		// the chunk was followed by more data, so hold on to the first byte of the next chunk
+		r.next = append(r.next[:0], chunk[len(chunk)-1])
+		chunk = chunk[:len(chunk)-1]
+	}
+
+	if len(chunk) < r.aead.Overhead() {
+		return errTruncatedStream
+	}
+
+	plaintext, err := r.aead.Open(chunk[:0], streamNonce(r.counter, final), chunk, r.aad)
+	if err != nil {
+		return err
+	}
+
+	// only an empty stream may end with an empty chunk
+	if final && len(plaintext) == 0 && r.counter > 0 {
+		return errTruncatedStream
+	}
+
+	r.plaintext = plaintext
+	r.counter++
+	r.done = final
+
+	return nil
+}
+
+// NewWriter returns a writer that encrypts everything written to it using the current data key, writing the encrypted
+// field to dst as it goes. Only a single chunk of the value is held in memory, allowing large values to be encrypted
+// without materializing them. The writer must be closed to write the final chunk. Values written this way can be read
+// using NewReader or by any serializer sharing the data keys.
+func (s *Serializer) NewWriter(ctx context.Context, dst io.Writer) (io.WriteCloser, error) {
+	if s.usage.Closed.Load() {
+		return nil, ErrClosed
+	}
+
+	key, err := s.currentKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dst.Write(database.FormatField(streamSuite.algorithm.ID, key.Fingerprint, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := newStreamWriter(dst, key.DataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingWriter{streamWriter: writer, usage: s.usage}, nil
+}
+
+// countingWriter records the value as encrypted once its stream has been closed.
+type countingWriter struct {
+	*streamWriter
+	usage *usage
+}
+
+func (w *countingWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	err := w.streamWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	w.usage.Encrypted.Add(1)
+
+	return nil
+}
+
+// maxStreamHeaderSize bounds how much of a reader is consumed while looking for the header of an encrypted field.
+const maxStreamHeaderSize = 256
+
+// NewReader returns a reader that decrypts a field written using NewWriter, or by the aes-gcm-stream serializer, as
+// it's read from src. Only a single chunk of the value is held in memory. Values bound to their column or compressed by
+// the serializer can only be read by the serializer itself.
+func (s *Serializer) NewReader(ctx context.Context, src io.Reader) (io.Reader, error) {
+	if s.usage.Closed.Load() {
+		return nil, ErrClosed
+	}
+
+	buffered := bufio.NewReader(src)
+
+	header := make([]byte, 0, maxStreamHeaderSize)
+	for delimiters := 0; delimiters < 2; {
+		b, err := buffered.ReadByte()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil, fmt.Errorf("field does not appear encrypted")
+		case err != nil:
+			return nil, err
+		case len(header) == maxStreamHeaderSize:
+			return nil, fmt.Errorf("field does not appear encrypted")
+		case b == ',' && len(header) > 4:
+			delimiters++
+		}
+
+		header = append(header, b)
+	}
+
+	algorithm, flags, fingerprint, _ := database.ParseFlaggedField(header)
+	switch {
+	case fingerprint == "":
+		return nil, fmt.Errorf("field does not appear encrypted")
+	case algorithm != streamSuite.algorithm.ID:
+		return nil, internal.UnexpectedAlgorithm(streamSuite.algorithm, algorithm)
+	case flags != 0:
+		return nil, fmt.Errorf("fields written with flags cannot be streamed: %d", flags)
+	}
+
+	key, err := s.get(ctx, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newStreamReader(buffered, key.DataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &countingReader{streamReader: reader, usage: s.usage}, nil
+}
+
+// countingReader records the value as decrypted once its final chunk has been read.
+type countingReader struct {
+	*streamReader
+	usage   *usage
+	counted bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.streamReader.Read(p)
+	if errors.Is(err, io.EOF) && !r.counted {
+		r.counted = true
+		r.usage.Decrypted.Add(1)
+	}
+
+	return n, err
+}
@@ -5,31 +5,48 @@ package internal
 
 import (
 	"crypto/rand"
+	"fmt"
+
+	"go.pitz.tech/gorm/encryption/database"
 )
 
 // Algorithm defines an encryption algorithm supported by this library.
-type Algorithm struct {
-	ID   byte
-	Name string
-}
+type Algorithm = database.Algorithm
 
 var (
-	Unknown = Algorithm{0, "unknown"}
-	AES     = Algorithm{1, "aes"}
-	AES_GCM = Algorithm{2, "aes-gcm"}
-
-	AlgorithmsByName = map[string]Algorithm{
-		Unknown.Name: Unknown,
-		AES.Name:     AES,
-		AES_GCM.Name: AES_GCM,
+	Unknown            = database.AlgorithmUnknown
+	AES                = database.AlgorithmAES
+	AES_GCM            = database.AlgorithmAESGCM
+	AES_GCM_RECORD     = database.AlgorithmAESGCMRecord
+	CHACHA20_POLY1305  = database.AlgorithmChaCha20Poly1305
+	XCHACHA20_POLY1305 = database.AlgorithmXChaCha20Poly1305
+	AES_SIV            = database.AlgorithmAESSIV
+	SEALED_BOX         = database.AlgorithmSealedBox
+	AES_GCM_STREAM     = database.AlgorithmAESGCMStream
+
+	// KeyedAlgorithms contains the algorithms whose values are encrypted using the data keys stored in the
+	// encryption_keys table, indexed by ID.
+	KeyedAlgorithms = map[byte]bool{
+		AES_GCM.ID:            true,
+		CHACHA20_POLY1305.ID:  true,
+		XCHACHA20_POLY1305.ID: true,
+		AES_GCM_STREAM.ID:     true,
 	}
+)
+
+// ErrClosed is returned when a serializer is used after it has been closed.
+var ErrClosed = fmt.Errorf("encryption serializer has been closed")
 
-	AlgorithmsByID = []Algorithm{
-		Unknown,
-		AES,
-		AES_GCM,
+// UnexpectedAlgorithm returns the error reported when a value was encrypted using a different algorithm than the one
+// expected. A *database.UnknownAlgorithmError is returned when the algorithm hasn't been registered.
+func UnexpectedAlgorithm(expected Algorithm, id byte) error {
+	actual, err := database.AlgorithmByID(id)
+	if err != nil {
+		return err
 	}
-)
+
+	return fmt.Errorf("expected %s but got: %s", expected.Name, actual.Name)
+}
 
 func GenerateKey() ([]byte, error) {
 	dataKey := make([]byte, 32)
@@ -0,0 +1,214 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+// Package siv implements AES-SIV, the deterministic authenticated encryption mode described by RFC 5297.
+package siv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"fmt"
+)
+
+const blockSize = aes.BlockSize
+
+// New constructs the AES-SIV AEAD for the provided key. The key must be 32, 48, or 64 bytes long. The first half of
+// the key is used to compute the synthetic IV while the second half is used to encrypt the plaintext. Since the IV is
+// derived from the plaintext, encrypting the same plaintext twice produces the same ciphertext. Nonces are optional and
+// are treated as an additional component of the associated data. Empty components are omitted.
+func New(key []byte) (*AEAD, error) {
+	switch len(key) {
+	case 32, 48, 64:
+	default:
+		return nil, fmt.Errorf("invalid AES-SIV key length: %d", len(key))
+	}
+
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &AEAD{mac: mac, ctr: ctr}
+
+	// compute the CMAC subkeys up front
+	mac.Encrypt(s.k1[:], s.k1[:])
+	s.k1 = dbl(s.k1)
+	s.k2 = dbl(s.k1)
+
+	return s, nil
+}
+
+// AEAD implements cipher.AEAD using AES-SIV, additionally allowing any number of associated data components to be
+// provided as described by RFC 5297.
+type AEAD struct {
+	mac cipher.Block
+	ctr cipher.Block
+
+	k1, k2 [blockSize]byte
+}
+
+// NonceSize returns 0 since nonces are optional.
+func (s *AEAD) NonceSize() int {
+	return 0
+}
+
+// Overhead returns the length of the synthetic IV prefixed to each ciphertext.
+func (s *AEAD) Overhead() int {
+	return blockSize
+}
+
+// Seal encrypts and authenticates the plaintext, appending the synthetic IV and ciphertext to dst.
+func (s *AEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	return s.SealComponents(dst, plaintext, additionalData, nonce)
+}
+
+// SealComponents encrypts and authenticates the plaintext using the provided components of the associated data,
+// appending the synthetic IV and ciphertext to dst. Unlike RFC 5297, empty components are omitted rather than
+// authenticated as empty strings, so a missing nonce and an empty nonce produce the same ciphertext.
+func (s *AEAD) SealComponents(dst, plaintext []byte, components ...[]byte) []byte {
+	v := s.s2v(plaintext, components...)
+
+	ret, out := sliceForAppend(dst, blockSize+len(plaintext))
+	copy(out, v[:])
+	s.xorKeyStream(v, out[blockSize:], plaintext)
+
+	return ret
+}
+
+// Open authenticates and decrypts the ciphertext, appending the plaintext to dst.
+func (s *AEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	return s.OpenComponents(dst, ciphertext, additionalData, nonce)
+}
+
+// OpenComponents authenticates and decrypts the ciphertext using the provided components of the associated data,
+// appending the plaintext to dst.
+func (s *AEAD) OpenComponents(dst, ciphertext []byte, components ...[]byte) ([]byte, error) {
+	if len(ciphertext) < blockSize {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+
+	var v [blockSize]byte
+	copy(v[:], ciphertext)
+
+	ret, out := sliceForAppend(dst, len(ciphertext)-blockSize)
+	s.xorKeyStream(v, out, ciphertext[blockSize:])
+
+	expected := s.s2v(out, components...)
+	if subtle.ConstantTimeCompare(expected[:], v[:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+
+		return nil, fmt.Errorf("message authentication failed")
+	}
+
+	return ret, nil
+}
+
+// xorKeyStream encrypts or decrypts src into dst using AES-CTR, starting from the synthetic IV.
+func (s *AEAD) xorKeyStream(v [blockSize]byte, dst, src []byte) {
+	// the 31st and 63rd bits (from the right) are cleared to allow the counter to be implemented using 64bit integers
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+
+	cipher.NewCTR(s.ctr, v[:]).XORKeyStream(dst, src)
+}
+
+// s2v computes the synthetic IV for the plaintext and the non-empty components of the associated data.
+func (s *AEAD) s2v(plaintext []byte, components ...[]byte) [blockSize]byte {
+	var zero [blockSize]byte
+	d := s.cmac(zero[:])
+
+	for _, component := range components {
+		if len(component) == 0 {
+			continue
+		}
+
+		d = dbl(d)
+		xor(d[:], s.cmac(component))
+	}
+
+	if len(plaintext) >= blockSize {
+		t := make([]byte, len(plaintext))
+		copy(t, plaintext)
+		xor(t[len(t)-blockSize:], d)
+
+		return s.cmac(t)
+	}
+
+	d = dbl(d)
+
+	var t [blockSize]byte
+	copy(t[:], plaintext)
+	t[len(plaintext)] = 0x80
+	xor(d[:], t)
+
+	return s.cmac(d[:])
+}
+
+// cmac computes the AES-CMAC of the message as described by RFC 4493.
+func (s *AEAD) cmac(message []byte) [blockSize]byte {
+	var x [blockSize]byte
+
+	for len(message) > blockSize {
+		xor(x[:], *(*[blockSize]byte)(message))
+		s.mac.Encrypt(x[:], x[:])
+		message = message[blockSize:]
+	}
+
+	var last [blockSize]byte
+	copy(last[:], message)
+
+	if len(message) == blockSize {
+		xor(last[:], s.k1)
+	} else {
+		last[len(message)] = 0x80
+		xor(last[:], s.k2)
+	}
+
+	xor(x[:], last)
+	s.mac.Encrypt(x[:], x[:])
+
+	return x
+}
+
+// dbl multiplies the block by x in GF(2^128).
+func dbl(b [blockSize]byte) [blockSize]byte {
+	var out [blockSize]byte
+
+	carry := b[0] >> 7
+	for i := 0; i < blockSize-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+
+	out[blockSize-1] = b[blockSize-1]<<1 ^ 0x87*carry
+
+	return out
+}
+
+// xor xors the block into dst.
+func xor(dst []byte, b [blockSize]byte) {
+	for i := range b {
+		dst[i] ^= b[i]
+	}
+}
+
+// sliceForAppend extends the slice by n bytes, returning the extended slice along with the new bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+
+	tail = head[len(in):]
+
+	return head, tail
+}
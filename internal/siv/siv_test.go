@@ -0,0 +1,128 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package siv_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"go.pitz.tech/gorm/encryption/internal/siv"
+)
+
+func decode(i *is.I, value string) []byte {
+	decoded, err := hex.DecodeString(value)
+	i.NoErr(err)
+
+	return decoded
+}
+
+func TestSIV(t *testing.T) {
+	i := is.New(t)
+
+	// RFC 5297, Appendix A.1
+	key := decode(i, "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad := decode(i, "101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext := decode(i, "112233445566778899aabbccddee")
+	expected := decode(i, "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c")
+
+	aead, err := siv.New(key)
+	i.NoErr(err)
+	i.Equal(0, aead.NonceSize())
+	i.Equal(16, aead.Overhead())
+
+	ciphertext := aead.Seal(nil, nil, plaintext, ad)
+	i.Equal(expected, ciphertext)
+
+	decrypted, err := aead.Open(nil, nil, ciphertext, ad)
+	i.NoErr(err)
+	i.Equal(plaintext, decrypted)
+
+	// tampering with the ciphertext or associated data is detected
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+
+	_, err = aead.Open(nil, nil, tampered, ad)
+	i.True(err != nil)
+
+	_, err = aead.Open(nil, nil, ciphertext, nil)
+	i.True(err != nil)
+
+	_, err = aead.Open(nil, nil, ciphertext[:15], ad)
+	i.True(err != nil)
+
+	// encryption is deterministic across plaintext lengths, including full and partial blocks
+	for _, length := range []int{0, 1, 15, 16, 17, 32, 100} {
+		plaintext := make([]byte, length)
+		for idx := range plaintext {
+			plaintext[idx] = byte(idx)
+		}
+
+		first := aead.Seal(nil, nil, plaintext, nil)
+		i.Equal(first, aead.Seal(nil, nil, plaintext, nil))
+		i.Equal(length+16, len(first))
+
+		decrypted, err := aead.Open(nil, nil, first, nil)
+		i.NoErr(err)
+		i.Equal(string(plaintext), string(decrypted))
+	}
+
+	_, err = siv.New(key[:16])
+	i.True(err != nil)
+}
+
+func TestSIVComponents(t *testing.T) {
+	i := is.New(t)
+
+	// RFC 5297, Appendix A.2
+	key := decode(i, "7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f")
+	ad1 := decode(i, "00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100")
+	ad2 := decode(i, "102030405060708090a0")
+	nonce := decode(i, "09f911029d74e35bd84156c5635688c0")
+	plaintext := decode(i, "7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553")
+	expected := decode(i, "7bdb6e3b432667eb06f4d14bff2fbd0fcb900f2fddbe404326601965c889bf17"+
+		"dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d")
+
+	aead, err := siv.New(key)
+	i.NoErr(err)
+
+	ciphertext := aead.SealComponents(nil, plaintext, ad1, ad2, nonce)
+	i.Equal(expected, ciphertext)
+
+	decrypted, err := aead.OpenComponents(nil, ciphertext, ad1, ad2, nonce)
+	i.NoErr(err)
+	i.Equal(plaintext, decrypted)
+
+	// the order of the components is authenticated
+	_, err = aead.OpenComponents(nil, ciphertext, ad2, ad1, nonce)
+	i.True(err != nil)
+
+	// Seal authenticates the associated data followed by the nonce
+	i.Equal(aead.SealComponents(nil, plaintext, ad1, nonce), aead.Seal(nil, nonce, plaintext, ad1))
+}
+
+func TestSIVEmptyComponents(t *testing.T) {
+	i := is.New(t)
+
+	key := decode(i, "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad := decode(i, "101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext := decode(i, "112233445566778899aabbccddee")
+
+	aead, err := siv.New(key)
+	i.NoErr(err)
+
+	// empty components are omitted, so they're indistinguishable from missing ones
+	expected := aead.SealComponents(nil, plaintext, ad)
+	i.Equal(expected, aead.Seal(nil, nil, plaintext, ad))
+	i.Equal(expected, aead.Seal(nil, []byte{}, plaintext, ad))
+	i.Equal(expected, aead.SealComponents(nil, plaintext, nil, ad, []byte{}))
+
+	decrypted, err := aead.Open(nil, []byte{}, expected, ad)
+	i.NoErr(err)
+	i.Equal(plaintext, decrypted)
+
+	// including when every component is empty
+	i.Equal(aead.SealComponents(nil, plaintext), aead.Seal(nil, []byte{}, plaintext, []byte{}))
+}
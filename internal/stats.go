@@ -0,0 +1,57 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package internal
+
+import (
+	"sync/atomic"
+)
+
+// Stats reports how a serializer has been used.
+type Stats struct {
+	// CacheHits is the number of times a data key was found in memory.
+	CacheHits int64
+	// CacheMisses is the number of times a data key needed to be loaded from the database.
+	CacheMisses int64
+	// CachedKeys is the number of data keys currently cached in memory for decrypting values.
+	CachedKeys int64
+	// ActiveKeys is the number of data keys currently used to encrypt new values, one per tenant.
+	ActiveKeys int64
+	// Encrypted is the total number of values encrypted.
+	Encrypted int64
+	// Decrypted is the total number of values decrypted.
+	Decrypted int64
+}
+
+// Add returns the sum of both stats.
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		CacheHits:   s.CacheHits + other.CacheHits,
+		CacheMisses: s.CacheMisses + other.CacheMisses,
+		CachedKeys:  s.CachedKeys + other.CachedKeys,
+		ActiveKeys:  s.ActiveKeys + other.ActiveKeys,
+		Encrypted:   s.Encrypted + other.Encrypted,
+		Decrypted:   s.Decrypted + other.Decrypted,
+	}
+}
+
+// Usage tracks how a serializer is used. Gorm copies serializers when operating on fields, so the counters are shared
+// between copies using a pointer.
+type Usage struct {
+	Closed atomic.Bool
+
+	Hits      atomic.Int64
+	Misses    atomic.Int64
+	Encrypted atomic.Int64
+	Decrypted atomic.Int64
+}
+
+// Stats returns a snapshot of the counters.
+func (u *Usage) Stats() Stats {
+	return Stats{
+		CacheHits:   u.Hits.Load(),
+		CacheMisses: u.Misses.Load(),
+		Encrypted:   u.Encrypted.Load(),
+		Decrypted:   u.Decrypted.Load(),
+	}
+}
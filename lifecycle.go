@@ -0,0 +1,75 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+var (
+	// ErrKeyDestroyed is returned when attempting to decrypt a value whose key has been destroyed.
+	ErrKeyDestroyed = database.ErrKeyDestroyed
+
+	// ErrKeyRetired is returned when attempting to decrypt a value whose key has been retired.
+	ErrKeyRetired = database.ErrKeyRetired
+
+	// ErrInvalidTransition is returned when a key cannot be moved into the requested status.
+	ErrInvalidTransition = database.ErrInvalidTransition
+)
+
+// TenantMismatchError is returned when attempting to decrypt a value whose key belongs to a different tenant than the
+// one associated with the context.
+type TenantMismatchError = database.TenantMismatchError
+
+// TransitionKey moves a data key into the provided status. Keys move through the following lifecycle:
+//
+//	active <-> decrypt-only <-> retired -> destroyed
+//
+// Active keys are used to encrypt new values. Decrypt-only keys are never used to encrypt new values, but continue to
+// decrypt existing ones. Retired keys fail to decrypt values, but can be restored. Destroyed keys have their data key
+// erased, making any values they protect permanently unreadable. Running processes observe the change once their cached
+// copy of the key expires.
+func TransitionKey(ctx context.Context, db *gorm.DB, fingerprint string, status database.KeyStatus) error {
+	return db.WithContext(ctx).Unscoped().Transaction(func(txn *gorm.DB) error {
+		key := &database.Key{}
+
+		err := txn.First(key, "fingerprint = ?", fingerprint).Error
+		if err != nil {
+			return err
+		}
+
+		if !key.Status.CanTransitionTo(status) {
+			return fmt.Errorf("%w: %s cannot move from %s to %s", ErrInvalidTransition, fingerprint, key.Status, status)
+		}
+
+		updates := map[string]any{
+			"status": status,
+		}
+
+		if status == database.KeyDestroyed {
+			updates["data_key"] = nil
+		}
+
+		return txn.Model(key).Updates(updates).Error
+	})
+}
+
+// DestroyTenantKeys crypto-shreds a tenant by destroying every data key that belongs to them, regardless of the current
+// status of the key. Once destroyed, any values encrypted for the tenant can no longer be decrypted.
+func DestroyTenantKeys(ctx context.Context, db *gorm.DB, tenant string) error {
+	return db.WithContext(ctx).
+		Unscoped().
+		Model(&database.Key{}).
+		Where("tenant = ?", tenant).
+		Updates(map[string]any{
+			"status":   database.KeyDestroyed,
+			"data_key": nil,
+		}).
+		Error
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package encryption
+
+import (
+	"context"
+	"io"
+
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption/aes"
+	"go.pitz.tech/gorm/encryption/internal/aesgcm"
+	"go.pitz.tech/gorm/encryption/sealedbox"
+)
+
+// ErrClosed is returned when encrypting or decrypting values after the Manager has been closed.
+var ErrClosed = aesgcm.ErrClosed
+
+// Stats reports how the serializers registered by a Manager have been used.
+type Stats = aesgcm.Stats
+
+// Manager provides a handle to the serializers configured by Register.
+type Manager struct {
+	db               *gorm.DB
+	prefetch         bool
+	aesSerializer    *aes.Serializer
+	serializer       *aesgcm.Serializer
+	recordSerializer *aesgcm.RecordSerializer
+
+	// sealedBoxSerializer is only configured when a public or private key is provided.
+	sealedBoxSerializer *sealedbox.Serializer
+}
+
+// ForceRotate immediately replaces the data key used to encrypt new values for the tenant associated with the context,
+// without waiting for the rotation duration to elapse.
+func (m *Manager) ForceRotate(ctx context.Context) error {
+	return m.serializer.Rotate(ctx)
+}
+
+// NewWriter returns a writer that encrypts everything written to it using the aes-gcm-stream algorithm and the current
+// data key for the tenant associated with the context, writing the encrypted field to dst as it goes. Large values,
+// such as documents, can be encrypted without holding them in memory. The writer must be closed once the value has been
+// written. The encrypted field can be stored in a column using the aes-gcm-stream serializer, or anywhere else.
+func (m *Manager) NewWriter(ctx context.Context, dst io.Writer) (io.WriteCloser, error) {
+	return m.serializer.NewWriter(ctx, dst)
+}
+
+// NewReader returns a reader that decrypts a field encrypted using the aes-gcm-stream algorithm as it's read from src.
+// An error is returned by the reader when the field has been truncated or tampered with.
+func (m *Manager) NewReader(ctx context.Context, src io.Reader) (io.Reader, error) {
+	return m.serializer.NewReader(ctx, src)
+}
+
+// Stats returns a snapshot of how the registered serializers have been used. Values written using algorithms registered
+// by RegisterAlgorithm aren't counted.
+func (m *Manager) Stats() Stats {
+	stats := m.serializer.Stats().Add(m.recordSerializer.Stats()).Add(m.aesSerializer.Stats())
+
+	if m.sealedBoxSerializer != nil {
+		stats = stats.Add(m.sealedBoxSerializer.Stats())
+	}
+
+	return stats
+}
+
+// Close discards any keys held in memory and removes the callbacks registered on the database. Once closed, values can
+// no longer be encrypted or decrypted using the registered serializers. Gorm doesn't allow callbacks to be removed
+// while statements are being executed, so the database must no longer be in use.
+func (m *Manager) Close() error {
+	closers := []io.Closer{m.serializer, m.recordSerializer, m.aesSerializer}
+	if m.sealedBoxSerializer != nil {
+		closers = append(closers, m.sealedBoxSerializer)
+	}
+
+	for _, closer := range closers {
+		err := closer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.prefetch {
+		err := m.serializer.RemovePrefetch(m.db)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.serializer.RemoveCallbacks(m.db)
+	if err != nil {
+		return err
+	}
+
+	return m.recordSerializer.RemoveCallbacks(m.db)
+}
@@ -0,0 +1,348 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go.pitz.tech/gorm/encryption/aes"
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+const (
+	// passphraseMetadata is the name of the metadata row containing the salt and parameters of the root key.
+	passphraseMetadata = "root_key_kdf"
+	// pendingPassphraseMetadata is the name of the metadata row used while upgrading the root key.
+	pendingPassphraseMetadata = "root_key_kdf.pending"
+)
+
+// ErrIncorrectPassphrase is returned when a passphrase derives a different root key than the one stored in the
+// database.
+var ErrIncorrectPassphrase = fmt.Errorf("passphrase does not match the stored root key")
+
+// KDFParams configures the cost of deriving a root key from a passphrase using Argon2id.
+type KDFParams struct {
+	// Time is the number of passes made over memory.
+	Time uint32
+	// Memory is the amount of memory used in KiB.
+	Memory uint32
+	// Threads is the degree of parallelism used.
+	Threads uint8
+}
+
+// DefaultKDFParams follows the second recommended option from RFC 9106.
+var DefaultKDFParams = KDFParams{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// kdf contains the salt and parameters used to derive a root key, along with the fingerprint of the derived key used to
+// verify the passphrase.
+type kdf struct {
+	KDFParams
+	Salt     []byte
+	Verifier string
+}
+
+func newKDF(params KDFParams) (kdf, error) {
+	salt := make([]byte, 16)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return kdf{}, err
+	}
+
+	return kdf{KDFParams: params, Salt: salt}, nil
+}
+
+// parseKDF parses the PHC string representation of a kdf.
+func parseKDF(value string) (kdf, error) {
+	k := kdf{}
+	version := 0
+	salt := ""
+
+	// the verifier takes the place of the hash, following the salt
+	if strings.Count(value, "$") > 4 {
+		idx := strings.LastIndex(value, "$")
+		value, k.Verifier = value[:idx], value[idx+1:]
+	}
+
+	_, err := fmt.Sscanf(value, "$argon2id$v=%d$m=%d,t=%d,p=%d$%s", &version, &k.Memory, &k.Time, &k.Threads, &salt)
+	if err != nil {
+		return kdf{}, fmt.Errorf("failed to parse kdf parameters: %w", err)
+	}
+
+	if version != argon2.Version {
+		return kdf{}, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+
+	k.Salt, err = base64.RawStdEncoding.DecodeString(salt)
+	if err != nil {
+		return kdf{}, fmt.Errorf("failed to parse kdf salt: %w", err)
+	}
+
+	return k, nil
+}
+
+// String returns the PHC string representation of the kdf.
+func (k kdf) String() string {
+	value := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s",
+		argon2.Version, k.Memory, k.Time, k.Threads, base64.RawStdEncoding.EncodeToString(k.Salt))
+
+	if k.Verifier != "" {
+		value += "$" + k.Verifier
+	}
+
+	return value
+}
+
+// Derive produces a 256bit root key from the passphrase.
+func (k kdf) Derive(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), k.Salt, k.Time, k.Memory, k.Threads, 32)
+}
+
+// Verify derives the root key from the passphrase, returning ErrIncorrectPassphrase when its fingerprint doesn't match
+// the verifier. Parameters stored without a verifier accept any passphrase.
+func (k kdf) Verify(passphrase string) ([]byte, error) {
+	key := k.Derive(passphrase)
+
+	if k.Verifier != "" && subtle.ConstantTimeCompare([]byte(k.Verifier), []byte(aes.Fingerprint(key))) != 1 {
+		return nil, ErrIncorrectPassphrase
+	}
+
+	return key, nil
+}
+
+// loadKDF reads the kdf stored under the provided name, returning nil when one doesn't exist.
+func loadKDF(db *gorm.DB, name string) (*kdf, error) {
+	metadata := &database.Metadata{}
+
+	err := db.First(metadata, "name = ?", name).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	k, err := parseKDF(metadata.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// passphraseKeys derives the root key from the passphrase using the parameters stored in the database, storing a new
+// salt, the provided parameters, and a verifier for the passphrase when none exist. ErrIncorrectPassphrase is returned
+// when the passphrase doesn't match the stored verifier. When an upgrade is in progress, the key derived using the
+// pending parameters is returned as a decryption key provided the passphrase matches it.
+func passphraseKeys(ctx context.Context, db *gorm.DB, passphrase string, params KDFParams) ([]byte, [][]byte, error) {
+	db = db.WithContext(ctx)
+
+	current, err := loadKDF(db, passphraseMetadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if current == nil {
+		initial, err := newKDF(params)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		initial.Verifier = aes.Fingerprint(initial.Derive(passphrase))
+
+		// another process may be initializing at the same time, only one of the salts is kept
+		err = db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&database.Metadata{Name: passphraseMetadata, Value: initial.String()}).
+			Error
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		current, err = loadKDF(db, passphraseMetadata)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := current.Verify(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pending, err := loadKDF(db, pendingPassphraseMetadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var decryptionKeys [][]byte
+	if pending != nil {
+		// the upgrade may be moving to another passphrase
+		if pendingKey, err := pending.Verify(passphrase); err == nil {
+			decryptionKeys = append(decryptionKeys, pendingKey)
+		}
+	}
+
+	return key, decryptionKeys, nil
+}
+
+// NeedsPassphraseUpgrade returns true when the root key was derived using parameters other than the ones provided.
+// Processes continue to derive the root key using the stored parameters until UpgradePassphrase is called.
+func NeedsPassphraseUpgrade(ctx context.Context, db *gorm.DB, params KDFParams) (bool, error) {
+	current, err := loadKDF(db.WithContext(ctx), passphraseMetadata)
+	if err != nil {
+		return false, err
+	}
+
+	return current == nil || current.KDFParams != params, nil
+}
+
+// UpgradePassphrase derives a new root key using the provided passphrase and parameters, re-wraps every data key using
+// it (including record keys), and then stores the new parameters so other processes derive the new root key. The
+// passphrase can be left unchanged to only upgrade the parameters. While the upgrade is running, processes using the
+// same passphrase are able to read data keys wrapped by either root key. If interrupted, the upgrade can be re-run with
+// the same arguments.
+//
+// Values written using the aes and aes-siv serializers are encrypted using the root key directly and cannot be migrated
+// by re-wrapping the data keys. Every model containing encrypted columns must be provided using WithModels. The upgrade
+// is refused with a KeyReferencedError while any of those values are encrypted using the current root key, and with
+// ErrNoModels when no models are provided.
+func UpgradePassphrase(
+	ctx context.Context,
+	db *gorm.DB,
+	oldPassphrase, newPassphrase string,
+	params KDFParams,
+	opts ...JobOption,
+) error {
+	cfg := &JobConfig{}
+	for _, opt := range opts {
+		opt.Apply(cfg)
+	}
+
+	if len(cfg.Models) == 0 {
+		return ErrNoModels
+	}
+
+	db = db.WithContext(ctx)
+
+	current, err := loadKDF(db, passphraseMetadata)
+	switch {
+	case err != nil:
+		return err
+	case current == nil:
+		return fmt.Errorf("%w: no passphrase has been configured", gorm.ErrRecordNotFound)
+	}
+
+	oldKey, err := current.Verify(oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	tables, err := rootKeyReferences(db, aes.Fingerprint(oldKey), cfg.Models)
+	switch {
+	case err != nil:
+		return err
+	case len(tables) > 0:
+		return &KeyReferencedError{Fingerprint: aes.Fingerprint(oldKey), Tables: tables}
+	}
+
+	pending, err := loadKDF(db, pendingPassphraseMetadata)
+	if err != nil {
+		return err
+	}
+
+	var newKey []byte
+
+	if pending == nil || pending.KDFParams != params {
+		next, err := newKDF(params)
+		if err != nil {
+			return err
+		}
+
+		newKey = next.Derive(newPassphrase)
+		next.Verifier = aes.Fingerprint(newKey)
+
+		err = db.Save(&database.Metadata{Name: pendingPassphraseMetadata, Value: next.String()}).Error
+		if err != nil {
+			return err
+		}
+
+		pending = &next
+	} else {
+		// data keys may already be wrapped using the pending root key, so an interrupted upgrade must be resumed using
+		// the same passphrase
+		newKey, err = pending.Verify(newPassphrase)
+		if err != nil {
+			return fmt.Errorf("%w: an upgrade to another passphrase is in progress", err)
+		}
+	}
+
+	err = RotateRootKey(ctx, db, LocalKeyProvider(oldKey), LocalKeyProvider(newKey), opts...)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(txn *gorm.DB) error {
+		err := txn.Model(&database.Metadata{}).
+			Where("name = ?", passphraseMetadata).
+			Update("value", pending.String()).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		return txn.Delete(&database.Metadata{Name: pendingPassphraseMetadata}).Error
+	})
+}
+
+// rootKeyReferences reports how many rows in the tables of the provided models contain values encrypted directly using
+// the root key with the provided fingerprint, indexed by the name of the table.
+func rootKeyReferences(db *gorm.DB, fingerprint string, models []any) (map[string]int64, error) {
+	tables := make(map[string]int64)
+
+	for _, model := range models {
+		sch, fields, err := parseEncryptedColumns(db, model, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		err = scanEncryptedColumns(db, sch, fields, 1000, nil, func(_ int, records []rawRecord) error {
+			for _, record := range records {
+				for _, value := range record.Values {
+					if _, referenced, _ := database.ParseField(value); referenced == fingerprint {
+						tables[sch.Table]++
+						break
+					}
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tables, nil
+}
@@ -0,0 +1,352 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+// Reencrypt migrates the encrypted columns of a model off of old data keys. Rows are scanned in batches and any row
+// containing a value that isn't encrypted using the current data key (including plaintext values) is re-saved, causing
+// it to be encrypted using the current key. Rows are only re-saved while their encrypted columns still hold the values
+// that were scanned, so rows written by the application in the meantime are skipped rather than overwritten. Values
+// encrypted using a different algorithm than the one configured for their column are re-saved as well, allowing columns
+// to move between algorithms sharing the same keys (or between any algorithms when universal decryption is enabled).
+// When no columns are provided, every encrypted column is migrated. The cursor reported after each batch is the last
+// primary key processed and can be used to resume the job. When data keys are scoped to tenants, the job should be run
+// for each tenant using a context the tenant resolver understands and a db scoped to the tenant's rows.
+func Reencrypt(ctx context.Context, db *gorm.DB, model any, columns []string, opts ...JobOption) error {
+	cfg := &JobConfig{
+		BatchSize: 100,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(cfg)
+	}
+
+	db = db.WithContext(ctx)
+
+	sch, fields, err := parseEncryptedColumns(db, model, columns)
+	if err != nil {
+		return err
+	}
+
+	selected := make([]string, 0, len(fields))
+	for _, field := range fields {
+		selected = append(selected, field.DBName)
+	}
+
+	algorithms := fieldAlgorithms(fields)
+	progress := Progress{Cursor: cfg.Cursor}
+
+	return scanEncryptedColumns(db, sch, fields, cfg.BatchSize, cfg.Cursor, func(batch int, records []rawRecord) error {
+		start := time.Now()
+
+		current, err := currentFingerprints(ctx, fields)
+		if err != nil {
+			return err
+		}
+
+		primaryKeys := make([]any, 0, len(records))
+		outdated := make(map[any]rawRecord, len(records))
+
+		for _, record := range records {
+			if len(record.outdated(current, algorithms)) > 0 {
+				primaryKeys = append(primaryKeys, record.PrimaryKey)
+				outdated[record.PrimaryKey] = record
+			}
+		}
+
+		updated := int64(0)
+
+		if len(primaryKeys) > 0 {
+			models := reflect.New(reflect.SliceOf(sch.ModelType))
+
+			// soft-deleted rows continue to reference old keys, so they need to be re-encrypted as well
+			err := db.Unscoped().Transaction(func(txn *gorm.DB) error {
+				err := txn.Where(clause.IN{Column: clause.PrimaryColumn, Values: primaryKeys}).Find(models.Interface()).Error
+				if err != nil {
+					return err
+				}
+
+				for i := 0; i < models.Elem().Len(); i++ {
+					model := models.Elem().Index(i)
+					row := model.Addr().Interface()
+					record := outdated[sch.PrioritizedPrimaryField.ReflectValueOf(ctx, model).Interface()]
+
+					// rows written by the application since they were scanned are left alone, since they've already
+					// been encrypted using the current key and writing them again would overwrite the change
+					result := txn.Model(row).Select(selected).Where(record.unchanged(fields)).UpdateColumns(row)
+					if result.Error != nil {
+						return result.Error
+					}
+
+					updated += result.RowsAffected
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		progress.Batch = batch
+		progress.Processed += int64(len(records))
+		progress.Updated += updated
+		progress.Cursor = records[len(records)-1].PrimaryKey
+
+		if cfg.Progress != nil {
+			cfg.Progress(progress)
+		}
+
+		if cfg.RateLimit > 0 {
+			wait := time.Duration(len(records))*time.Second/time.Duration(cfg.RateLimit) - time.Since(start)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		return nil
+	})
+}
+
+// CountRemaining reports how many rows of a model still contain values that need to be re-encrypted, grouped by the
+// fingerprint of the data key that was used to encrypt them. Plaintext values are reported using an empty fingerprint.
+// When no columns are provided, every encrypted column is checked.
+func CountRemaining(ctx context.Context, db *gorm.DB, model any, columns []string) (map[string]int64, error) {
+	db = db.WithContext(ctx)
+
+	sch, fields, err := parseEncryptedColumns(db, model, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := currentFingerprints(ctx, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithms := fieldAlgorithms(fields)
+	remaining := make(map[string]int64)
+
+	err = scanEncryptedColumns(db, sch, fields, 1000, nil, func(_ int, records []rawRecord) error {
+		for _, record := range records {
+			for fingerprint := range record.outdated(current, algorithms) {
+				remaining[fingerprint]++
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return remaining, nil
+}
+
+// keyedSerializer is implemented by the serializers that can report the key and algorithm used to encrypt new values.
+type keyedSerializer interface {
+	CurrentFingerprint(ctx context.Context) (string, error)
+	AlgorithmID() byte
+}
+
+// currentFingerprints returns the fingerprint of the key currently used to encrypt new values for each field.
+func currentFingerprints(ctx context.Context, fields []*schema.Field) ([]string, error) {
+	fingerprints := make([]string, 0, len(fields))
+
+	for _, field := range fields {
+		fingerprint, err := field.Serializer.(keyedSerializer).CurrentFingerprint(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	return fingerprints, nil
+}
+
+// fieldAlgorithms returns the ID of the algorithm used to encrypt new values for each field.
+func fieldAlgorithms(fields []*schema.Field) []byte {
+	algorithms := make([]byte, 0, len(fields))
+
+	for _, field := range fields {
+		algorithms = append(algorithms, field.Serializer.(keyedSerializer).AlgorithmID())
+	}
+
+	return algorithms
+}
+
+// parseEncryptedColumns parses the schema for the provided model and looks up the fields for the provided columns.
+func parseEncryptedColumns(db *gorm.DB, model any, columns []string) (*schema.Schema, []*schema.Field, error) {
+	stmt := &gorm.Statement{DB: db}
+
+	err := stmt.Parse(model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sch := stmt.Schema
+	if sch.PrioritizedPrimaryField == nil {
+		return nil, nil, gorm.ErrPrimaryKeyRequired
+	}
+
+	fields := make([]*schema.Field, 0, len(columns))
+
+	if len(columns) == 0 {
+		for _, field := range sch.Fields {
+			if _, ok := field.Serializer.(keyedSerializer); ok && field.DBName != "" {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	for _, column := range columns {
+		field := sch.LookUpField(column)
+		if field == nil || field.DBName == "" {
+			return nil, nil, fmt.Errorf("unknown column: %s", column)
+		}
+
+		fields = append(fields, field)
+	}
+
+	for _, field := range fields {
+		if _, ok := field.Serializer.(keyedSerializer); !ok {
+			return nil, nil, fmt.Errorf("column %s cannot be re-encrypted", field.DBName)
+		}
+	}
+
+	return sch, fields, nil
+}
+
+// rawRecord contains the primary key of a row along with the raw, encrypted values of its columns.
+type rawRecord struct {
+	PrimaryKey any
+	Values     [][]byte
+}
+
+// unchanged returns the conditions matching the row only while its encrypted columns still hold the values in the
+// record.
+func (r rawRecord) unchanged(fields []*schema.Field) clause.Expression {
+	conditions := make([]clause.Expression, 0, len(fields))
+
+	for idx, field := range fields {
+		var value any
+		if r.Values[idx] != nil {
+			value = r.Values[idx]
+		}
+
+		conditions = append(conditions, clause.Eq{Column: clause.Column{Name: field.DBName}, Value: value})
+	}
+
+	return clause.And(conditions...)
+}
+
+// references returns the set of data keys referenced by the encrypted values in the record.
+func (r rawRecord) references() map[string]bool {
+	fingerprints := make(map[string]bool)
+
+	for _, value := range r.Values {
+		algorithm, fingerprint, _ := database.ParseField(value)
+		if internal.KeyedAlgorithms[algorithm] && fingerprint != "" {
+			fingerprints[fingerprint] = true
+		}
+	}
+
+	return fingerprints
+}
+
+// outdated returns the set of fingerprints used by values in the record that aren't encrypted using the current data
+// key and algorithm for their field.
+func (r rawRecord) outdated(current []string, algorithms []byte) map[string]bool {
+	fingerprints := make(map[string]bool)
+
+	for idx, value := range r.Values {
+		if len(value) == 0 {
+			continue
+		}
+
+		algorithm, fingerprint, _ := database.ParseField(value)
+		if algorithm != algorithms[idx] || fingerprint != current[idx] {
+			fingerprints[fingerprint] = true
+		}
+	}
+
+	return fingerprints
+}
+
+// scanEncryptedColumns reads the raw values of the provided fields in batches, bypassing their serializers.
+func scanEncryptedColumns(
+	db *gorm.DB,
+	sch *schema.Schema,
+	fields []*schema.Field,
+	batchSize int,
+	cursor any,
+	fn func(batch int, records []rawRecord) error,
+) error {
+	primaryKey := sch.PrioritizedPrimaryField
+
+	structFields := []reflect.StructField{
+		{
+			Name: "PrimaryKey",
+			Type: primaryKey.FieldType,
+			Tag:  reflect.StructTag(fmt.Sprintf(`gorm:"column:%s;primaryKey"`, primaryKey.DBName)),
+		},
+	}
+
+	for idx, field := range fields {
+		structFields = append(structFields, reflect.StructField{
+			Name: fmt.Sprintf("Column%d", idx),
+			Type: reflect.TypeOf([]byte{}),
+			Tag:  reflect.StructTag(fmt.Sprintf(`gorm:"column:%s"`, field.DBName)),
+		})
+	}
+
+	rows := reflect.New(reflect.SliceOf(reflect.StructOf(structFields)))
+
+	query := db.Table(sch.Table)
+	if cursor != nil {
+		query = query.Where(clause.Gt{Column: clause.PrimaryColumn, Value: cursor})
+	}
+
+	return query.
+		FindInBatches(rows.Interface(), batchSize, func(_ *gorm.DB, batch int) error {
+			records := make([]rawRecord, 0, rows.Elem().Len())
+
+			for i := 0; i < rows.Elem().Len(); i++ {
+				row := rows.Elem().Index(i)
+
+				record := rawRecord{
+					PrimaryKey: row.Field(0).Interface(),
+					Values:     make([][]byte, 0, len(fields)),
+				}
+
+				for idx := range fields {
+					record.Values = append(record.Values, row.Field(idx+1).Bytes())
+				}
+
+				records = append(records, record)
+			}
+
+			return fn(batch, records)
+		}).
+		Error
+}
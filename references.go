@@ -0,0 +1,179 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+	"go.pitz.tech/gorm/encryption/internal/aesgcm"
+)
+
+// References reports how many rows in each table reference a data key, indexed by the fingerprint of the key and then
+// the name of the table.
+type References map[string]map[string]int64
+
+// Count returns the total number of rows referencing the provided key.
+func (r References) Count(fingerprint string) int64 {
+	count := int64(0)
+	for _, rows := range r[fingerprint] {
+		count += rows
+	}
+
+	return count
+}
+
+// KeyReferencedError is returned when attempting to delete a data key that's still referenced by encrypted values.
+type KeyReferencedError struct {
+	Fingerprint string
+	Tables      map[string]int64
+}
+
+func (e *KeyReferencedError) Error() string {
+	return fmt.Sprintf("encryption key %s is still referenced by %d tables", e.Fingerprint, len(e.Tables))
+}
+
+// ErrNoModels is returned when checking for references without providing any models to scan. Gorm doesn't provide a
+// way to list every model, so the models containing encrypted columns must be provided explicitly.
+var ErrNoModels = fmt.Errorf("no models provided to scan for references")
+
+// FindReferences scans every column of the provided models encrypted using data keys and reports which data keys are
+// referenced by the stored values. At least one model must be provided.
+func FindReferences(ctx context.Context, db *gorm.DB, models ...any) (References, error) {
+	if len(models) == 0 {
+		return nil, ErrNoModels
+	}
+
+	db = db.WithContext(ctx)
+
+	references := make(References)
+
+	for _, model := range models {
+		sch, fields, err := parseEncryptedColumns(db, model, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		err = scanEncryptedColumns(db, sch, fields, 1000, nil, func(_ int, records []rawRecord) error {
+			for _, record := range records {
+				for fingerprint := range record.references() {
+					if references[fingerprint] == nil {
+						references[fingerprint] = make(map[string]int64)
+					}
+
+					references[fingerprint][sch.Table]++
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return references, nil
+}
+
+// ErrKeyNotRetired is returned when attempting to delete a data key that could still be used to encrypt or decrypt
+// values without forcing the deletion.
+var ErrKeyNotRetired = fmt.Errorf("only retired or destroyed keys can be deleted")
+
+// DeleteKey permanently removes a data key from the encryption_keys table. Unless forced, only keys that have been
+// retired or destroyed are deleted, and ErrKeyNotRetired is returned for every other key. Before the key is removed,
+// the provided models are scanned for values that still reference the key. Unless forced, referenced keys are not
+// deleted and a KeyReferencedError is returned instead. Every model containing encrypted columns should be provided,
+// since only those models are checked. ErrNoModels is returned when none are provided and the deletion isn't forced.
+// The status of the key is checked again as it's deleted, within the same transaction as the scan, so keys put back
+// into use while being scanned are never deleted. Once deleted, the key is dropped from the keys held in memory by the
+// registered serializers, but other processes continue to use their cached copy until it expires.
+func DeleteKey(ctx context.Context, db *gorm.DB, fingerprint string, force bool, models ...any) error {
+	if !force && len(models) == 0 {
+		return ErrNoModels
+	}
+
+	deletable := []database.KeyStatus{database.KeyRetired, database.KeyDestroyed}
+
+	err := db.WithContext(ctx).Unscoped().Transaction(func(txn *gorm.DB) error {
+		if force {
+			return deleteKey(txn, fingerprint)
+		}
+
+		key := &database.Key{}
+
+		err := txn.First(key, "fingerprint = ?", fingerprint).Error
+		switch {
+		case err != nil:
+			return err
+		case key.Status != database.KeyRetired && key.Status != database.KeyDestroyed:
+			return fmt.Errorf("%w: %s is %s", ErrKeyNotRetired, fingerprint, key.Status)
+		}
+
+		references, err := FindReferences(ctx, txn, models...)
+		if err != nil {
+			return err
+		}
+
+		if references.Count(fingerprint) > 0 {
+			return &KeyReferencedError{
+				Fingerprint: fingerprint,
+				Tables:      references[fingerprint],
+			}
+		}
+
+		// the key may have been put back into use while the models were being scanned
+		return deleteKey(txn.Where("status IN ?", deletable), fingerprint)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	evictKey(fingerprint)
+
+	return nil
+}
+
+// deleteKey removes the key from the encryption_keys table, returning gorm.ErrRecordNotFound when no key was deleted.
+func deleteKey(db *gorm.DB, fingerprint string) error {
+	result := db.Delete(&database.Key{}, "fingerprint = ?", fingerprint)
+	switch {
+	case result.Error != nil:
+		return result.Error
+	case result.RowsAffected == 0:
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// evictKey drops the key from the memory of the registered serializers using data keys, so it's no longer used to
+// encrypt new values.
+func evictKey(fingerprint string) {
+	for _, algorithm := range []internal.Algorithm{
+		internal.AES_GCM,
+		internal.CHACHA20_POLY1305,
+		internal.XCHACHA20_POLY1305,
+		internal.AES_GCM_STREAM,
+	} {
+		serializer, ok := schema.GetSerializer(algorithm.Name)
+		if !ok {
+			continue
+		}
+
+		if serializer, ok := serializer.(*aesgcm.Serializer); ok {
+			serializer.Evict(fingerprint)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+// JobConfig contains the configuration used by long-running jobs such as rotating the root key.
+type JobConfig struct {
+	BatchSize int
+	Cursor    any
+	Progress  func(Progress)
+	RateLimit int
+	Models    []any
+}
+
+// Apply this configuration to the provided configuration.
+func (c JobConfig) Apply(cfg *JobConfig) {
+	if c.BatchSize > 0 {
+		cfg.BatchSize = c.BatchSize
+	}
+
+	if c.Cursor != nil {
+		cfg.Cursor = c.Cursor
+	}
+
+	if c.Progress != nil {
+		cfg.Progress = c.Progress
+	}
+
+	if c.RateLimit > 0 {
+		cfg.RateLimit = c.RateLimit
+	}
+
+	if c.Models != nil {
+		cfg.Models = c.Models
+	}
+}
+
+// JobOptionFunc provides a function-based implementation of a JobOption.
+type JobOptionFunc func(cfg *JobConfig)
+
+// Apply runs the underlying function provided it's not-nil.
+func (fn JobOptionFunc) Apply(cfg *JobConfig) {
+	if fn != nil {
+		fn(cfg)
+	}
+}
+
+// JobOption provides a common definition on how to configure optional parameters of a job.
+type JobOption interface {
+	Apply(cfg *JobConfig)
+}
+
+// WithBatchSize configures how many rows are processed in a single transaction.
+func WithBatchSize(batchSize int) JobOption {
+	return JobOptionFunc(func(cfg *JobConfig) {
+		cfg.BatchSize = batchSize
+	})
+}
+
+// WithCursor resumes a job after the provided cursor. Cursors are reported using the Progress callback.
+func WithCursor(cursor any) JobOption {
+	return JobOptionFunc(func(cfg *JobConfig) {
+		cfg.Cursor = cursor
+	})
+}
+
+// WithProgress configures a callback that's invoked after each batch is committed.
+func WithProgress(progress func(Progress)) JobOption {
+	return JobOptionFunc(func(cfg *JobConfig) {
+		cfg.Progress = progress
+	})
+}
+
+// WithRateLimit limits how many rows are processed per second. This is only supported by jobs that scan application
+// tables, such as Reencrypt.
+func WithRateLimit(rowsPerSecond int) JobOption {
+	return JobOptionFunc(func(cfg *JobConfig) {
+		cfg.RateLimit = rowsPerSecond
+	})
+}
+
+// WithModels provides the models containing encrypted columns to jobs that need to check the values stored in them,
+// such as UpgradePassphrase.
+func WithModels(models ...any) JobOption {
+	return JobOptionFunc(func(cfg *JobConfig) {
+		cfg.Models = models
+	})
+}
+
+// Progress reports how far along a job is. The Cursor can be passed to WithCursor to resume the job from where it
+// left off.
+type Progress struct {
+	Batch     int
+	Processed int64
+	Updated   int64
+	Cursor    any
+}
+
+// RotationCursor identifies where RotateRootKey left off, using the table being rotated and the fingerprint of the last
+// key rotated within it.
+type RotationCursor struct {
+	Table       string
+	Fingerprint string
+}
+
+// rotatedKey holds the columns of a wrapped data key needed to rotate it, regardless of the table it's stored in.
+type rotatedKey struct {
+	Fingerprint string `gorm:"column:fingerprint;primaryKey"`
+	DataKey     []byte `gorm:"column:data_key"`
+	Status      database.KeyStatus
+}
+
+// rotatedTables contains the tables storing data keys wrapped using the root key, in the order they're rotated.
+var rotatedTables = []struct {
+	model   any
+	columns []string
+}{
+	{model: &database.Key{}, columns: []string{"fingerprint", "data_key", "status"}},
+	{model: &database.RecordKey{}, columns: []string{"fingerprint", "data_key"}},
+}
+
+// RotateRootKey re-wraps every data key in the encryption_keys and encryption_record_keys tables, moving them from the
+// oldKey to the newKey. Before any changes are committed, every data key is checked to ensure it can be unwrapped using
+// the oldKey. Keys are then re-wrapped in batches, each within their own transaction. Keys already wrapped by the newKey
+// are skipped, allowing the rotation to be safely resumed from the RotationCursor reported by the progress callback or
+// re-run. Destroyed keys no longer have a data key and are skipped as well. Keys wrapped using the legacy aes algorithm
+// are always re-wrapped, so passing the same provider as both the oldKey and newKey migrates them to the current
+// algorithm without changing the root key.
+func RotateRootKey(ctx context.Context, db *gorm.DB, oldKey, newKey database.KeyProvider, opts ...JobOption) error {
+	cfg := &JobConfig{
+		BatchSize: 100,
+	}
+
+	for _, opt := range opts {
+		opt.Apply(cfg)
+	}
+
+	// soft-deleted keys may still be protecting data, so they need to be rotated as well
+	db = db.WithContext(ctx).Unscoped().Session(&gorm.Session{})
+
+	tables := make([]string, 0, len(rotatedTables))
+	columns := make(map[string][]string, len(rotatedTables))
+
+	for _, rotated := range rotatedTables {
+		stmt := &gorm.Statement{DB: db}
+
+		err := stmt.Parse(rotated.model)
+		if err != nil {
+			return err
+		}
+
+		// applications only using the shared data keys may not have migrated the record keys
+		if db.Migrator().HasTable(stmt.Schema.Table) {
+			tables = append(tables, stmt.Schema.Table)
+			columns[stmt.Schema.Table] = rotated.columns
+		}
+	}
+
+	cursor := RotationCursor{}
+	switch c := cfg.Cursor.(type) {
+	case nil:
+	case RotationCursor:
+		cursor = c
+	case string:
+		// cursors reported before record keys were rotated only contain the fingerprint of a data key
+		cursor = RotationCursor{Table: database.Key{}.TableName(), Fingerprint: c}
+	default:
+		return fmt.Errorf("rotation cursor must be a RotationCursor, got: %T", cfg.Cursor)
+	}
+
+	// tables are rotated in order, so tables before the one in the cursor have already been rotated
+	for idx, table := range tables {
+		if table == cursor.Table {
+			tables = tables[idx:]
+			break
+		}
+	}
+
+	keysAfter := func(table string) *gorm.DB {
+		after := ""
+		if table == cursor.Table {
+			after = cursor.Fingerprint
+		}
+
+		return db.Table(table).Select(columns[table]).Where("fingerprint > ?", after)
+	}
+
+	skip := func(key rotatedKey) bool {
+		algorithm, fingerprint, _ := database.ParseField(key.DataKey)
+		return key.Status == database.KeyDestroyed || (fingerprint == newKey.KeyID() && algorithm != internal.AES.ID)
+	}
+
+	// verify all keys before committing any changes
+
+	keys := make([]rotatedKey, 0, cfg.BatchSize)
+
+	for _, table := range tables {
+		err := keysAfter(table).
+			FindInBatches(&keys, cfg.BatchSize, func(_ *gorm.DB, _ int) error {
+				for _, key := range keys {
+					if skip(key) {
+						continue
+					}
+
+					_, err := oldKey.Unwrap(ctx, key.DataKey)
+					if err != nil {
+						return fmt.Errorf("failed to unwrap data key %s: %w", key.Fingerprint, err)
+					}
+				}
+
+				return nil
+			}).
+			Error
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// rotate
+
+	progress := Progress{Cursor: cfg.Cursor}
+
+	for _, table := range tables {
+		err := keysAfter(table).
+			FindInBatches(&keys, cfg.BatchSize, func(_ *gorm.DB, _ int) error {
+				updated := int64(0)
+
+				err := db.Transaction(func(txn *gorm.DB) error {
+					for _, key := range keys {
+						if skip(key) {
+							continue
+						}
+
+						dataKey, err := oldKey.Unwrap(ctx, key.DataKey)
+						if err != nil {
+							return fmt.Errorf("failed to unwrap data key %s: %w", key.Fingerprint, err)
+						}
+
+						wrapped, err := newKey.Wrap(ctx, dataKey)
+						if err != nil {
+							return fmt.Errorf("failed to wrap data key %s: %w", key.Fingerprint, err)
+						}
+
+						err = txn.Table(table).
+							Where("fingerprint = ?", key.Fingerprint).
+							Update("data_key", wrapped).
+							Error
+
+						if err != nil {
+							return err
+						}
+
+						updated++
+					}
+
+					return nil
+				})
+
+				if err != nil {
+					return err
+				}
+
+				// batches are numbered across every table
+				progress.Batch++
+				progress.Processed += int64(len(keys))
+				progress.Updated += updated
+				progress.Cursor = RotationCursor{Table: table, Fingerprint: keys[len(keys)-1].Fingerprint}
+
+				if cfg.Progress != nil {
+					cfg.Progress(progress)
+				}
+
+				return nil
+			}).
+			Error
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
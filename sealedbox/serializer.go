@@ -0,0 +1,251 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package sealedbox
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+)
+
+// GenerateKey generates a new X25519 key pair. The public key can be distributed to every process writing values while
+// the private key only needs to be available to the processes reading them.
+func GenerateKey() (publicKey, privateKey []byte, err error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return public[:], private[:], nil
+}
+
+// New constructs a new Serializer that encrypts values using the provided public key and decrypts them using the
+// provided private keys. A Serializer constructed without private keys can write values but never read them back.
+// When no public key is provided, the public half of the first private key is used. Additional private keys allow
+// values encrypted using previous key pairs to be read while rotating between them. An error is returned when a key is
+// invalid or no keys are provided.
+func New(publicKey []byte, privateKeys ...[]byte) (*Serializer, error) {
+	serializer := &Serializer{
+		keys:  make(map[string]keyPair, len(privateKeys)),
+		usage: &internal.Usage{},
+	}
+
+	pairs := make([]keyPair, 0, len(privateKeys))
+	for _, privateKey := range privateKeys {
+		pair, err := newKeyPair(privateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		pairs = append(pairs, pair)
+		serializer.keys[Fingerprint(pair.public[:])] = pair
+	}
+
+	switch {
+	case publicKey == nil && len(pairs) > 0:
+		serializer.recipient = pairs[0].public
+	case publicKey == nil:
+		return nil, fmt.Errorf("a public or private key is required")
+	case len(publicKey) != 32:
+		return nil, fmt.Errorf("public key must be 32 bytes but got: %d", len(publicKey))
+	default:
+		// low-order points produce a shared secret anyone can compute, which X25519 reports as an error
+		_, err := curve25519.X25519(curve25519.Basepoint, publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %w", err)
+		}
+
+		serializer.recipient = new([32]byte)
+		copy(serializer.recipient[:], publicKey)
+	}
+
+	serializer.fingerprint = Fingerprint(serializer.recipient[:])
+
+	return serializer, nil
+}
+
+// keyPair holds a private key along with its public half, which is needed to open a sealed box.
+type keyPair struct {
+	public  *[32]byte
+	private *[32]byte
+}
+
+func newKeyPair(privateKey []byte) (keyPair, error) {
+	if len(privateKey) != 32 {
+		return keyPair{}, fmt.Errorf("private key must be 32 bytes but got: %d", len(privateKey))
+	}
+
+	pair := keyPair{
+		public:  new([32]byte),
+		private: new([32]byte),
+	}
+
+	copy(pair.private[:], privateKey)
+
+	public, err := curve25519.X25519(pair.private[:], curve25519.Basepoint)
+	if err != nil {
+		return keyPair{}, err
+	}
+
+	copy(pair.public[:], public)
+
+	return pair, nil
+}
+
+// Fingerprint computes the fingerprint used to identify the provided public key.
+func Fingerprint(publicKey []byte) string {
+	hash := hmac.New(sha256.New, nil)
+	hash.Write(publicKey)
+
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// UnknownKeyError is returned when a value was encrypted using a public key whose private key wasn't provided,
+// including every value read by a Serializer that was only given a public key.
+type UnknownKeyError struct {
+	Fingerprint string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("no private key found for fingerprint: %s", e.Fingerprint)
+}
+
+// Serializer provides a Gorm serializer that encrypts database fields using anonymous sealed boxes (X25519,
+// XSalsa20, and Poly1305). Each value is encrypted using a new ephemeral key pair and the recipient's public key, so
+// writing values requires no secrets at all. Only processes holding the recipient's private key can read them, which
+// makes it well suited for services that collect sensitive data they should never be able to read back.
+type Serializer struct {
+	fingerprint string
+	recipient   *[32]byte
+	keys        map[string]keyPair
+
+	// usage is shared between copies of the serializer, since gorm copies serializers when operating on fields.
+	usage *internal.Usage
+
+	// fallback reads values written using other algorithms, when configured.
+	fallback schema.SerializerInterface
+}
+
+// WithFallback returns a Serializer that reads values written using other algorithms using the fallback, rather than
+// returning an error. New values are still written using sealed boxes.
+func (s *Serializer) WithFallback(fallback schema.SerializerInterface) *Serializer {
+	variant := *s
+	variant.fallback = fallback
+
+	return &variant
+}
+
+// Stats reports how a Serializer has been used.
+type Stats = internal.Stats
+
+// Stats returns a snapshot of how the serializer has been used. Values read using the fallback aren't counted.
+func (s *Serializer) Stats() Stats {
+	return s.usage.Stats()
+}
+
+// Close erases the private keys held in memory and prevents the serializer from being used to encrypt or decrypt any
+// more values.
+func (s *Serializer) Close() error {
+	s.usage.Closed.Store(true)
+
+	// keys are shared between copies of the serializer, so erasing them in place erases them from every copy
+	for _, key := range s.keys {
+		clear(key.private[:])
+	}
+
+	return nil
+}
+
+// Scan decrypts the data before setting it on the object.
+func (s *Serializer) Scan(ctx context.Context, schema *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	if s.usage.Closed.Load() {
+		return internal.ErrClosed
+	}
+
+	data, ok := dbValue.([]byte)
+	if !ok {
+		return fmt.Errorf("encryption only works on []byte data")
+	}
+
+	algorithm, fingerprint, ciphertext := database.ParseField(data)
+	switch {
+	case fingerprint == "":
+		// field does not appear encrypted, treat data as plaintext
+		schema.ReflectValueOf(ctx, dst).SetBytes(ciphertext)
+
+		return nil
+	case algorithm != internal.SEALED_BOX.ID && s.fallback != nil:
+		return s.fallback.Scan(ctx, schema, dst, dbValue)
+	case algorithm != internal.SEALED_BOX.ID:
+		return internal.UnexpectedAlgorithm(internal.SEALED_BOX, algorithm)
+	}
+
+	plaintext, err := s.decrypt(fingerprint, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	s.usage.Decrypted.Add(1)
+
+	schema.ReflectValueOf(ctx, dst).SetBytes(plaintext)
+
+	return nil
+}
+
+// Value encrypts the data before sending it to the database.
+func (s *Serializer) Value(_ context.Context, _ *schema.Field, _ reflect.Value, fieldValue interface{}) (interface{}, error) {
+	if s.usage.Closed.Load() {
+		return nil, internal.ErrClosed
+	}
+
+	plaintext, ok := fieldValue.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("encryption only works on []byte data")
+	}
+
+	ciphertext, err := box.SealAnonymous(nil, plaintext, s.recipient, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	s.usage.Encrypted.Add(1)
+
+	return database.FormatField(internal.SEALED_BOX.ID, s.fingerprint, ciphertext), nil
+}
+
+// CurrentFingerprint returns the fingerprint of the public key used to encrypt new values, allowing columns to be
+// re-encrypted using the current key pair.
+func (s *Serializer) CurrentFingerprint(context.Context) (string, error) {
+	return s.fingerprint, nil
+}
+
+// AlgorithmID returns the ID of the algorithm used to encrypt new values.
+func (s *Serializer) AlgorithmID() byte {
+	return internal.SEALED_BOX.ID
+}
+
+func (s *Serializer) decrypt(fingerprint string, ciphertext []byte) ([]byte, error) {
+	key, ok := s.keys[fingerprint]
+	if !ok {
+		return nil, &UnknownKeyError{Fingerprint: fingerprint}
+	}
+
+	plaintext, ok := box.OpenAnonymous(nil, ciphertext, key.public, key.private)
+	if !ok {
+		return nil, fmt.Errorf("failed to open %s value", internal.SEALED_BOX.Name)
+	}
+
+	return plaintext, nil
+}
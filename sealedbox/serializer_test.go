@@ -0,0 +1,132 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package sealedbox_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+	"gorm.io/gorm/schema"
+
+	"go.pitz.tech/gorm/encryption/database"
+	"go.pitz.tech/gorm/encryption/internal"
+	"go.pitz.tech/gorm/encryption/sealedbox"
+)
+
+type record struct {
+	Value []byte
+}
+
+func scan(serializer schema.SerializerInterface, value []byte) ([]byte, error) {
+	sch, err := schema.Parse(&record{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		return nil, err
+	}
+
+	dst := &record{}
+
+	err = serializer.Scan(context.Background(), sch.FieldsByName["Value"], reflect.ValueOf(dst), value)
+
+	return dst.Value, err
+}
+
+func TestSerializer(t *testing.T) {
+	i := is.New(t)
+	ctx := context.Background()
+
+	publicKey, privateKey, err := sealedbox.GenerateKey()
+	i.NoErr(err)
+
+	writer, err := sealedbox.New(publicKey)
+	i.NoErr(err)
+
+	reader, err := sealedbox.New(nil, privateKey)
+	i.NoErr(err)
+
+	fingerprint, err := reader.CurrentFingerprint(ctx)
+	i.NoErr(err)
+	i.Equal(sealedbox.Fingerprint(publicKey), fingerprint)
+
+	for _, plaintext := range [][]byte{{}, []byte("hello world"), bytes.Repeat([]byte("a"), 4096)} {
+		value, err := writer.Value(ctx, nil, reflect.Value{}, plaintext)
+		i.NoErr(err)
+
+		algorithm, fingerprint, ciphertext := database.ParseField(value.([]byte))
+		i.Equal(internal.SEALED_BOX.ID, algorithm)
+		i.Equal(sealedbox.Fingerprint(publicKey), fingerprint)
+		i.Equal(len(plaintext)+48, len(ciphertext))
+
+		// each value is sealed using a new ephemeral key
+		again, err := writer.Value(ctx, nil, reflect.Value{}, plaintext)
+		i.NoErr(err)
+		i.True(!bytes.Equal(value.([]byte), again.([]byte)))
+
+		decrypted, err := scan(reader, value.([]byte))
+		i.NoErr(err)
+		i.True(bytes.Equal(plaintext, decrypted))
+
+		// writers only hold the public key, so they cannot read values back
+		unknown := &sealedbox.UnknownKeyError{}
+
+		_, err = scan(writer, value.([]byte))
+		i.True(errors.As(err, &unknown))
+		i.Equal(fingerprint, unknown.Fingerprint)
+
+		// tampered values fail to open
+		tampered := bytes.Clone(value.([]byte))
+		tampered[len(tampered)-1] ^= 1
+
+		_, err = scan(reader, tampered)
+		i.True(err != nil)
+	}
+
+	// values written using previous key pairs can still be read
+	_, rotated, err := sealedbox.GenerateKey()
+	i.NoErr(err)
+
+	value, err := writer.Value(ctx, nil, reflect.Value{}, []byte("hello world"))
+	i.NoErr(err)
+
+	rotating, err := sealedbox.New(nil, rotated, privateKey)
+	i.NoErr(err)
+
+	decrypted, err := scan(rotating, value.([]byte))
+	i.NoErr(err)
+	i.Equal("hello world", string(decrypted))
+
+	// plaintext values are read as is
+	decrypted, err = scan(reader, []byte("hello world"))
+	i.NoErr(err)
+	i.Equal("hello world", string(decrypted))
+
+	// values written using other algorithms are rejected
+	_, err = scan(reader, database.FormatField(internal.AES_GCM.ID, fingerprint, []byte("ciphertext")))
+	i.True(err != nil)
+}
+
+func TestInvalidKeys(t *testing.T) {
+	i := is.New(t)
+
+	publicKey, privateKey, err := sealedbox.GenerateKey()
+	i.NoErr(err)
+
+	for _, keys := range [][][]byte{
+		{nil},
+		{make([]byte, 16)},
+		{nil, make([]byte, 16)},
+		{make([]byte, 16), privateKey},
+		{publicKey, privateKey, make([]byte, 16)},
+		// low-order public keys, which produce a predictable shared secret
+		{make([]byte, 32)},
+		{append([]byte{1}, make([]byte, 31)...)},
+	} {
+		_, err := sealedbox.New(keys[0], keys[1:]...)
+		i.True(err != nil)
+	}
+}
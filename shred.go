@@ -0,0 +1,44 @@
+// Copyright (C) 2023 Mya Pitzeruse
+// SPDX-License-Identifier: MIT
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+
+	"go.pitz.tech/gorm/encryption/database"
+)
+
+// ShredRecord crypto-shreds a single record by deleting every key used to encrypt its aes-gcm-record fields. Once
+// shredded, the encrypted fields of the record can no longer be read, including from copies of the record kept in
+// backups. The record itself is left in place and must be deleted separately if desired. The provided model must have
+// its primary key set.
+func ShredRecord(ctx context.Context, db *gorm.DB, model any) error {
+	db = db.WithContext(ctx)
+
+	stmt := &gorm.Statement{DB: db}
+
+	err := stmt.Parse(model)
+	if err != nil {
+		return err
+	}
+
+	primaryKey := stmt.Schema.PrioritizedPrimaryField
+	if primaryKey == nil {
+		return gorm.ErrPrimaryKeyRequired
+	}
+
+	recordID, zero := primaryKey.ValueOf(ctx, reflect.Indirect(reflect.ValueOf(model)))
+	if zero {
+		return fmt.Errorf("%w: %s", gorm.ErrMissingWhereClause, primaryKey.DBName)
+	}
+
+	return db.
+		Where("table_name = ? AND record_id = ?", stmt.Schema.Table, fmt.Sprint(recordID)).
+		Delete(&database.RecordKey{}).
+		Error
+}